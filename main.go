@@ -2,16 +2,44 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/damonpetta/rowi/server"
+	"os"
+	"time"
 )
 
 var address = flag.String("listen", "0.0.0.0:8000", "Server address")
 var docroot = flag.String("docroot", "./wiki", "Document root directory")
 var relativePath = flag.String("prefix", "", " Url path relativePath")
+var bare = flag.Bool("bare", false, "Document root is a bare git repository")
+var branch = flag.String("branch", "", "Branch served from the bare repository, HEAD by default")
+var mirrorURL = flag.String("mirror", "", "Remote repository cloned into the document root and fetched periodically")
+var mirrorInterval = flag.Duration("mirror-interval", 10*time.Minute, "Delay between fetches of the mirror")
+var mirrorSSHKey = flag.String("mirror-ssh-key", "", "Private key of the ssh remote")
+var gitBackend = flag.String("git-backend", server.GitBackendAuto, "How the history is read: go reads the repository directly, exec runs git, auto picks go unless the repository format is not supported")
 
 func main() {
 	flag.Parse()
 
-	srv := server.NewServer(*address, *relativePath, *docroot)
+	switch *gitBackend {
+	case server.GitBackendAuto, server.GitBackendGo, server.GitBackendExec:
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown git backend %q, use auto, go or exec\n", *gitBackend)
+		os.Exit(2)
+	}
+
+	srv := server.NewServer(*address, *relativePath, *docroot, server.Options{
+		Bare:   *bare,
+		Branch: *branch,
+
+		MirrorURL:      *mirrorURL,
+		MirrorInterval: *mirrorInterval,
+		// the token is not a flag, so it's not seen in the list of processes
+		MirrorToken:  os.Getenv("GITHUB_TOKEN"),
+		MirrorSSHKey: *mirrorSSHKey,
+		HookSecret:   os.Getenv("WEBHOOK_SECRET"),
+
+		GitBackend: *gitBackend,
+	})
 	srv.Run()
 }
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxContributors - number of contributors shown for a page
+const maxContributors = 5
+
+// fileStat - authorship of the file collected from the history
+type fileStat struct {
+	LastModifiedBy string
+	LastModifiedAt time.Time
+	LastCommit     *GitLog        // commit of the last modification
+	commits        map[string]int // author -> number of commits
+}
+
+// Contributors - most active authors of the file
+func (s *fileStat) Contributors() []string {
+	authors := make([]string, 0, len(s.commits))
+	for author := range s.commits {
+		authors = append(authors, author)
+	}
+
+	sort.Slice(authors, func(i, j int) bool {
+		if s.commits[authors[i]] != s.commits[authors[j]] {
+			return s.commits[authors[i]] > s.commits[authors[j]]
+		}
+
+		return authors[i] < authors[j]
+	})
+
+	if len(authors) > maxContributors {
+		authors = authors[:maxContributors]
+	}
+
+	return authors
+}
+
+// maxCachedHistories - histories of commits kept in memory, the live wiki and its snapshots share them
+const maxCachedHistories = 4
+
+// fileHistory - renames and authorship of the files collected from the whole history up to a commit
+type fileHistory struct {
+	once    sync.Once
+	renames []FileRename
+	stats   map[string]*fileStat
+	latest  *fileStat // latest commit
+	err     error
+}
+
+// historyCache - histories by commit, the most recently used ones are kept
+type historyCache struct {
+	items map[string]*fileHistory
+	order []string // commits from the least to the most recently used
+	mx    sync.Mutex
+}
+
+// getHistory - renames and authorship of every file up to the commit, the history is walked once per commit,
+// so rescans of the same head don't walk it again
+func (r *Renderer) getHistory(commit string) (*fileHistory, error) {
+	cache := r.history
+	cache.mx.Lock()
+	if cache.items == nil {
+		cache.items = make(map[string]*fileHistory)
+	}
+
+	item, ok := cache.items[commit]
+	if !ok {
+		item = &fileHistory{}
+		cache.items[commit] = item
+	}
+
+	for i, c := range cache.order {
+		if c == commit {
+			cache.order = append(cache.order[:i], cache.order[i+1:]...)
+			break
+		}
+	}
+
+	cache.order = append(cache.order, commit)
+	if len(cache.order) > maxCachedHistories {
+		delete(cache.items, cache.order[0])
+		cache.order = cache.order[1:]
+	}
+	cache.mx.Unlock()
+
+	// concurrent scans of the same commit wait for a single walk
+	item.once.Do(func() {
+		if item.renames, item.err = r.backend.Renames(commit); item.err != nil {
+			return
+		}
+
+		logs, err := r.backend.Log(LogQuery{Revisions: []string{commit}, Files: true})
+		if err != nil {
+			item.err = err
+			return
+		}
+
+		item.stats, item.latest = fileStats(logs, item.renames)
+	})
+
+	if item.err != nil {
+		// the failure is not cached, the next scan tries again
+		cache.mx.Lock()
+		if cache.items[commit] == item {
+			delete(cache.items, commit)
+			for i, c := range cache.order {
+				if c == commit {
+					cache.order = append(cache.order[:i], cache.order[i+1:]...)
+					break
+				}
+			}
+		}
+		cache.mx.Unlock()
+	}
+
+	return item, item.err
+}
+
+// fileStats - authorship of the files changed by the commits, newest first. Renames of the same history
+// carry the authorship from before a move over to the new name
+func fileStats(logs []GitLog, renames []FileRename) (map[string]*fileStat, *fileStat) {
+	stats := make(map[string]*fileStat)
+	moved := make(map[string]string) // old path -> name of the file in the newest commit
+	pending := append([]FileRename{}, renames...)
+	var latest *fileStat
+	for i := range logs {
+		commit := &logs[i]
+		author, date := commit.Author.Name, commit.Author.Date
+		if latest == nil {
+			latest = &fileStat{LastModifiedBy: author, LastModifiedAt: date, LastCommit: commit}
+		}
+
+		// the rename commit lists both names of the file, the old one is counted under the new name
+		changed := make(map[string]bool, len(commit.Files))
+		for _, file := range commit.Files {
+			changed[file] = true
+		}
+
+		renamed := make(map[string]string)
+		for j := 0; j < len(pending); j++ {
+			if rename := pending[j]; changed[rename.OldPath] && changed[rename.NewPath] {
+				renamed[rename.OldPath] = rename.NewPath
+				pending = append(pending[:j], pending[j+1:]...)
+				j--
+			}
+		}
+
+		for _, file := range commit.Files {
+			if _, ok := renamed[file]; ok {
+				continue
+			}
+
+			name := file
+			if newer, ok := moved[file]; ok {
+				name = newer
+			}
+
+			// commits go from the newest one, so the first one is the last modification
+			stat, ok := stats[name]
+			if !ok {
+				stat = &fileStat{LastModifiedBy: author, LastModifiedAt: date, LastCommit: commit, commits: make(map[string]int)}
+				stats[name] = stat
+			}
+
+			stat.commits[author]++
+		}
+
+		// older commits of the old name belong to the file under its newest name
+		for oldPath, newPath := range renamed {
+			if newer, ok := moved[newPath]; ok {
+				newPath = newer
+			}
+
+			moved[oldPath] = newPath
+		}
+	}
+
+	return stats, latest
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFileStats(t *testing.T) {
+	commit := func(author, date string, files ...string) GitLog {
+		when, _ := time.Parse(time.RFC3339, date)
+		return GitLog{Author: GitLogUser{Name: author, Date: when}, Files: files}
+	}
+
+	logs := []GitLog{
+		commit("Bob", "2024-03-02T10:00:00+01:00", "runbooks/db.md"),
+		commit("Ann", "2024-03-01T10:00:00Z", "runbooks/db.md", "Home.md"),
+		commit("Ann", "2024-02-01T10:00:00Z", "runbooks/db.md"),
+		commit("Carl", "2024-01-01T10:00:00Z"),
+	}
+
+	stats, latest := fileStats(logs, nil)
+	if latest.LastModifiedBy != "Bob" {
+		t.Errorf("unexpected latest commit: %+v", latest)
+	}
+
+	db := stats["runbooks/db.md"]
+	if db.LastModifiedBy != "Bob" || db.LastModifiedAt.Day() != 2 {
+		t.Errorf("unexpected last modification: %+v", db)
+	}
+
+	if got := db.Contributors(); !reflect.DeepEqual(got, []string{"Ann", "Bob"}) {
+		t.Errorf("unexpected contributors: %v", got)
+	}
+
+	if db.LastCommit != &logs[0] || stats["Home.md"].LastCommit != &logs[1] {
+		t.Errorf("unexpected last commits: %+v, %+v", db.LastCommit, stats["Home.md"].LastCommit)
+	}
+
+	if stats["Home.md"].LastModifiedBy != "Ann" {
+		t.Errorf("unexpected last modification: %+v", stats["Home.md"])
+	}
+}
+
+func TestFileStatsFollowRenames(t *testing.T) {
+	commit := func(author string, files ...string) GitLog {
+		return GitLog{Author: GitLogUser{Name: author}, Files: files}
+	}
+
+	logs := []GitLog{
+		commit("Dan", "db.md"),
+		commit("Carl", "runbooks/db.md", "runbooks/database.md"),
+		commit("Ann", "db.md", "runbooks/db.md"),
+		commit("Bob", "db.md"),
+		commit("Eve", "db.md"),
+	}
+
+	renames := []FileRename{
+		{OldPath: "runbooks/db.md", NewPath: "runbooks/database.md"},
+		{OldPath: "db.md", NewPath: "runbooks/db.md"},
+	}
+
+	// the page was moved twice, then a new page took its first name
+	stats, _ := fileStats(logs, renames)
+	database := stats["runbooks/database.md"]
+	if database == nil || database.LastModifiedBy != "Carl" {
+		t.Fatalf("unexpected last modification: %+v", database)
+	}
+
+	if got := database.Contributors(); !reflect.DeepEqual(got, []string{"Ann", "Bob", "Carl", "Eve"}) {
+		t.Errorf("unexpected contributors: %v", got)
+	}
+
+	if got := stats["db.md"].Contributors(); !reflect.DeepEqual(got, []string{"Dan"}) {
+		t.Errorf("unexpected contributors of the new page: %v", got)
+	}
+
+	if stats["runbooks/db.md"] != nil {
+		t.Errorf("expected no stats of the old name, got %+v", stats["runbooks/db.md"])
+	}
+}
+
+// countingBackend - backend which counts walks of the whole history
+type countingBackend struct {
+	GitBackend
+	walks int32
+}
+
+func (b *countingBackend) Renames(revision string) ([]FileRename, error) {
+	atomic.AddInt32(&b.walks, 1)
+	return b.GitBackend.Renames(revision)
+}
+
+func (b *countingBackend) Log(query LogQuery) ([]GitLog, error) {
+	if query.MaxCount == 0 && len(query.Paths) == 0 {
+		atomic.AddInt32(&b.walks, 1)
+	}
+
+	return b.GitBackend.Log(query)
+}
+
+func TestScanStorageCachesHistory(t *testing.T) {
+	dir := filepath.Dir(fixtureRepo(t))
+	r := NewRenderer(dir, make(chan interface{}, 10))
+	backend := &countingBackend{GitBackend: r.backend}
+	r.backend = backend
+
+	r.scanStorage()
+	if backend.walks != 2 {
+		t.Fatalf("expected renames and authorship to be collected, got %d walks", backend.walks)
+	}
+
+	page, err := r.GetPage("runbooks/notes")
+	if err != nil || page.Content.LastModifiedBy != "Ann" {
+		t.Fatalf("unexpected authorship of the page: %+v, %v", page.Content, err)
+	}
+
+	// the notes were edited by Bob before Ann moved them into the folder
+	if !reflect.DeepEqual(page.Content.Contributors, []string{"Ann", "Bob"}) {
+		t.Errorf("unexpected contributors of the moved page: %v", page.Content.Contributors)
+	}
+
+	// files changed without a commit don't change the history
+	if err := ioutil.WriteFile(filepath.Join(dir, "Start.md"), []byte("# Start\n\nDraft\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r.scanStorage()
+	head, _ := r.backend.RevParse("HEAD")
+	if _, err := r.Snapshot(head); err != nil {
+		t.Fatal(err)
+	}
+
+	if backend.walks != 2 {
+		t.Errorf("expected the history of the same head to be reused, got %d walks", backend.walks)
+	}
+
+	if page, _ := r.GetPage("runbooks/notes"); page.Content.LastModifiedBy != "Ann" {
+		t.Errorf("unexpected authorship after the rescan: %+v", page.Content)
+	}
+
+	v1, _ := r.backend.RevParse("v1")
+	if _, err := r.Snapshot(v1); err != nil {
+		t.Fatal(err)
+	}
+
+	if backend.walks != 4 {
+		t.Errorf("expected the history of another commit to be walked, got %d walks", backend.walks)
+	}
+}
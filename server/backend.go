@@ -0,0 +1,182 @@
+package server
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Git backends
+const (
+	GitBackendAuto = "auto" // the repository is read directly unless its format is not supported
+	GitBackendGo   = "go"   // the repository is read directly, no git binary is needed
+	GitBackendExec = "exec" // git is run for every request
+)
+
+// GitBackend - read access to the history of the wiki
+type GitBackend interface {
+	// RevParse - full name of the commit the revision points to: master, v1, HEAD~2, abbreviated names
+	RevParse(revision string) (string, error)
+	// Log - commits matching the query, newest first
+	Log(query LogQuery) ([]GitLog, error)
+	// Count - number of commits matching the query, Skip and MaxCount are ignored
+	Count(query LogQuery) (int, error)
+	// Show - content of the file at the revision, the object itself if the path is empty
+	Show(revision, path string) ([]byte, error)
+	// Tree - all files of the commit
+	Tree(commit string) ([]TreeFile, error)
+	// Blobs - content of the objects read at once
+	Blobs(names []string) (map[string][]byte, error)
+	// Diff - changes between two revisions limited to the paths if any, sizes are filled for images and
+	// binary files, renames are detected
+	Diff(first, second string, paths ...string) ([]FileDiff, error)
+	// Blame - commit which introduced every line of the file at the revision
+	Blame(revision, file string) ([]BlameBlock, error)
+	// Renames - files renamed in the history up to the revision, newest first, merges are skipped
+	Renames(revision string) ([]FileRename, error)
+	// RemoteURL - url of the remote repository
+	RemoteURL(name string) (string, error)
+}
+
+// LogQuery - commits to list, empty fields are not applied
+type LogQuery struct {
+	Revisions []string // commits to start from
+	NoWalk    bool     // list the revisions themselves in the given order, parents are not walked
+	Paths     []string // files or folders, commits which don't change them are skipped
+	Follow    bool     // follow renames of the single file of Paths
+	Author    string   // regular expression matched against "Name <email>" of the author
+	Grep      string   // regular expression matched against the message, case insensitive
+	Since     string   // any date git understands: 2024-01-01, "1 week ago"
+	Until     string
+	Skip      int
+	MaxCount  int  // 0 for all commits
+	Files     bool // fill files changed by every commit, merges come without files
+}
+
+// TreeFile - file of the tree
+type TreeFile struct {
+	Path string
+	Blob string
+}
+
+// FileRename - file moved by a commit
+type FileRename struct {
+	OldPath string
+	NewPath string
+}
+
+// newGitBackend - backend of the kind for the git directory, in auto mode the repository is read directly if
+// its format is supported and git is run otherwise
+func newGitBackend(gitDir, kind string) GitBackend {
+	switch kind {
+	case GitBackendExec:
+		return &execBackend{gitDir: gitDir}
+	case GitBackendGo:
+		return &goBackend{dir: gitDir}
+	}
+
+	if backend := pickGitBackend(gitDir); backend != nil {
+		return backend
+	}
+
+	// the mirror clones the repository after the start, so the backend is picked when it appears
+	return &autoBackend{gitDir: gitDir}
+}
+
+// pickGitBackend - backend which reads the repository, nil if there is no repository yet
+func pickGitBackend(gitDir string) GitBackend {
+	_, err := openGitRepository(gitDir)
+	if err == nil {
+		return &goBackend{dir: gitDir}
+	}
+
+	if _, lookErr := exec.LookPath(gitBinary); lookErr != nil {
+		// there is nothing to fall back to, the repository may appear later
+		return &goBackend{dir: gitDir}
+	}
+
+	git := &execBackend{gitDir: gitDir}
+	if _, statErr := os.Stat(gitDir); statErr != nil {
+		return nil
+	} else if _, gitErr := git.git("rev-parse", "--verify", "--quiet", "HEAD"); gitErr != nil {
+		// a clone which is running or a repository without commits
+		return nil
+	}
+
+	log.Infof("Running git to read %s: %v", gitDir, err)
+	return git
+}
+
+// autoBackend - backend of the repository which doesn't exist yet, git is run until the repository appears
+// and then the backend is picked for good
+type autoBackend struct {
+	gitDir  string
+	backend GitBackend
+	mx      sync.Mutex
+}
+
+// get - picked backend or git if there is no repository yet
+func (b *autoBackend) get() GitBackend {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.backend == nil {
+		if b.backend = pickGitBackend(b.gitDir); b.backend == nil {
+			return &execBackend{gitDir: b.gitDir}
+		}
+	}
+
+	return b.backend
+}
+
+// RevParse - full name of the commit the revision points to
+func (b *autoBackend) RevParse(revision string) (string, error) {
+	return b.get().RevParse(revision)
+}
+
+// Log - commits matching the query
+func (b *autoBackend) Log(query LogQuery) ([]GitLog, error) {
+	return b.get().Log(query)
+}
+
+// Count - number of commits matching the query
+func (b *autoBackend) Count(query LogQuery) (int, error) {
+	return b.get().Count(query)
+}
+
+// Show - content of the file at the revision
+func (b *autoBackend) Show(revision, path string) ([]byte, error) {
+	return b.get().Show(revision, path)
+}
+
+// Tree - all files of the commit
+func (b *autoBackend) Tree(commit string) ([]TreeFile, error) {
+	return b.get().Tree(commit)
+}
+
+// Blobs - content of the objects read at once
+func (b *autoBackend) Blobs(names []string) (map[string][]byte, error) {
+	return b.get().Blobs(names)
+}
+
+// Diff - changes between two revisions
+func (b *autoBackend) Diff(first, second string, paths ...string) ([]FileDiff, error) {
+	return b.get().Diff(first, second, paths...)
+}
+
+// Blame - commit which introduced every line of the file
+func (b *autoBackend) Blame(revision, file string) ([]BlameBlock, error) {
+	return b.get().Blame(revision, file)
+}
+
+// Renames - files renamed in the history up to the revision
+func (b *autoBackend) Renames(revision string) ([]FileRename, error) {
+	return b.get().Renames(revision)
+}
+
+// RemoteURL - url of the remote repository
+func (b *autoBackend) RemoteURL(name string) (string, error) {
+	return b.get().RemoteURL(name)
+}
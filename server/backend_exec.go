@@ -0,0 +1,438 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// gitBinary - git run by the exec backend and the mirror
+const gitBinary = "/usr/bin/git"
+
+// gitTimeout - git commands running longer are killed
+const gitTimeout = 30 * time.Second
+
+// ErrGitTimeout - git command was killed after gitTimeout
+var ErrGitTimeout = fmt.Errorf("git took longer than %v", gitTimeout)
+
+// gitLogFields - placeholders of the fields of GitLog in the order parseGitLog reads them
+var gitLogFields = []string{"%H", "%h", "%T", "%t", "%P", "%p", "%D", "%e", "%s", "%f", "%b", "%N", "%G?", "%GS", "%GK",
+	"%aN", "%aE", "%aI", "%cN", "%cE", "%cI"}
+
+// gitLogFormat - every commit starts with the record separator and every field ends with a zero byte, git
+// can't put zero bytes into the fields, so no subject or body can break the output
+var gitLogFormat = "--format=%x1e" + strings.Join(gitLogFields, "%x00") + "%x00"
+
+// execBackend - backend which runs git and parses its output
+type execBackend struct {
+	gitDir string
+}
+
+// git - run git command against the repository, it's killed after gitTimeout
+func (b *execBackend) git(args ...string) ([]byte, error) {
+	return b.gitInput("", args...)
+}
+
+// gitInput - run git command with the input
+func (b *execBackend) gitInput(input string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, gitBinary, append([]string{"--git-dir", b.gitDir}, args...)...)
+	if input != "" {
+		cmd.Stdin = strings.NewReader(input)
+	}
+
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return out, ErrGitTimeout
+	}
+
+	return out, err
+}
+
+// RevParse - full name of the commit
+func (b *execBackend) RevParse(revision string) (string, error) {
+	out, err := b.git("rev-parse", "--verify", "--quiet", "--end-of-options", revision+"^{commit}")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// logArgs - options, revisions and paths of git log and git rev-list for the query
+func logArgs(query LogQuery) []string {
+	args := []string{}
+	if query.NoWalk {
+		args = append(args, "--no-walk=unsorted")
+	}
+
+	if query.Follow {
+		args = append(args, "--follow")
+	}
+
+	if query.Author != "" {
+		args = append(args, "--author="+query.Author)
+	}
+
+	if query.Since != "" {
+		args = append(args, "--since="+query.Since)
+	}
+
+	if query.Until != "" {
+		args = append(args, "--until="+query.Until)
+	}
+
+	if query.Grep != "" {
+		args = append(args, "--grep="+query.Grep, "--regexp-ignore-case")
+	}
+
+	args = append(append(args, "--end-of-options"), query.Revisions...)
+	return append(append(args, "--"), query.Paths...)
+}
+
+// Log - commits matching the query
+func (b *execBackend) Log(query LogQuery) ([]GitLog, error) {
+	args := []string{}
+	if query.MaxCount > 0 {
+		args = append(args, "--max-count", strconv.Itoa(query.MaxCount))
+	}
+
+	if query.Skip > 0 {
+		args = append(args, "--skip", strconv.Itoa(query.Skip))
+	}
+
+	args = append(args, logArgs(query)...)
+	if !query.Files {
+		return b.gitLog("", args...)
+	}
+
+	// file names can't go into the json, so commits are listed with their files first and read in the second call
+	renames := "--no-renames"
+	if query.Follow {
+		renames = "-M"
+	}
+
+	out, err := b.git(append([]string{"-c", "core.quotePath=false", "log", "--format=%x00%H", "--name-only", renames}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := []string{}
+	files := make(map[string][]string)
+	for _, chunk := range strings.Split(string(out), "\x00")[1:] {
+		lines := strings.Split(chunk, "\n")
+		commits = append(commits, lines[0])
+		for _, line := range lines[1:] {
+			if line != "" {
+				files[lines[0]] = append(files[lines[0]], line)
+			}
+		}
+	}
+
+	if len(commits) == 0 {
+		return []GitLog{}, nil
+	}
+
+	logs, err := b.gitLog(strings.Join(commits, "\n")+"\n", "--no-walk=unsorted", "--stdin")
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range logs {
+		logs[i].Files = files[logs[i].Commit]
+	}
+
+	return logs, nil
+}
+
+// gitLog - run git log with the arguments and parse commits
+func (b *execBackend) gitLog(input string, args ...string) ([]GitLog, error) {
+	out, err := b.gitInput(input, append([]string{"log", gitLogFormat}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseGitLog(string(out)), nil
+}
+
+// parseGitLog - parse git log output in gitLogFormat, commits which can't be parsed are logged and skipped
+func parseGitLog(out string) []GitLog {
+	results := []GitLog{}
+	fields := strings.Split(out, "\x00")
+	for i := 0; i+len(gitLogFields) <= len(fields); {
+		record := fields[i : i+len(gitLogFields)]
+		// commits are separated by line breaks
+		commit := strings.TrimLeft(record[0], "\n")
+		if !strings.HasPrefix(commit, "\x1e") {
+			log.Errorf("Unexpected output of git log: %q", record[0])
+			i = nextGitLogRecord(fields, i+1)
+			continue
+		}
+
+		i += len(gitLogFields)
+		record[0] = commit[1:]
+		result, err := gitLogRecord(record)
+		if err != nil {
+			log.Errorf("Can't parse the commit %q: %v", record[0], err)
+			continue
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// nextGitLogRecord - index of the field which starts the next commit
+func nextGitLogRecord(fields []string, i int) int {
+	for ; i < len(fields); i++ {
+		if strings.HasPrefix(strings.TrimLeft(fields[i], "\n"), "\x1e") {
+			break
+		}
+	}
+
+	return i
+}
+
+// gitLogRecord - commit of the fields of gitLogFields
+func gitLogRecord(fields []string) (GitLog, error) {
+	result := GitLog{
+		Commit:               fields[0],
+		AbbreviatedCommit:    fields[1],
+		Tree:                 fields[2],
+		AbbreviatedTree:      fields[3],
+		Parent:               fields[4],
+		AbbreviatedParent:    fields[5],
+		Refs:                 fields[6],
+		Encoding:             fields[7],
+		Subject:              fields[8],
+		SanitizedSubjectLine: fields[9],
+		Body:                 fields[10],
+		CommitNotes:          fields[11],
+		VerificationFlag:     fields[12],
+		Signer:               fields[13],
+		SignerKey:            fields[14],
+		Author:               GitLogUser{Name: fields[15], Email: fields[16]},
+		Commiter:             GitLogUser{Name: fields[18], Email: fields[19]},
+	}
+
+	if !isObjectName(result.Commit) {
+		return result, fmt.Errorf("%q is not an object name", result.Commit)
+	}
+
+	var err error
+	if result.Author.Date, err = time.Parse(time.RFC3339, fields[17]); err != nil {
+		return result, err
+	}
+
+	if result.Commiter.Date, err = time.Parse(time.RFC3339, fields[20]); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// Count - number of commits matching the query
+func (b *execBackend) Count(query LogQuery) (int, error) {
+	out, err := b.git(append([]string{"rev-list", "--count"}, logArgs(query)...)...)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(out)))
+}
+
+// Show - content of the file at the revision
+func (b *execBackend) Show(revision, path string) ([]byte, error) {
+	object := revision
+	if path != "" {
+		object += ":" + path
+	}
+
+	return b.git("cat-file", "blob", "--end-of-options", object)
+}
+
+// Tree - all files of the commit
+func (b *execBackend) Tree(commit string) ([]TreeFile, error) {
+	out, err := b.git("ls-tree", "-r", "-z", "--full-tree", "--end-of-options", commit)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []TreeFile{}
+	for _, entry := range strings.Split(string(out), "\x00") {
+		// <mode> SP <type> SP <object> TAB <file>
+		tab := strings.IndexByte(entry, '\t')
+		if tab < 0 {
+			continue
+		}
+
+		fields := strings.Fields(entry[:tab])
+		if len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+
+		files = append(files, TreeFile{Path: entry[tab+1:], Blob: fields[2]})
+	}
+
+	return files, nil
+}
+
+// Blobs - content of the objects read with a single git cat-file --batch
+func (b *execBackend) Blobs(names []string) (map[string][]byte, error) {
+	contents := make(map[string][]byte)
+	if len(names) == 0 {
+		return contents, nil
+	}
+
+	out, err := b.gitInput(strings.Join(names, "\n")+"\n", "cat-file", "--batch")
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(out))
+	for {
+		// <object> SP <type> SP <size> LF <content> LF
+		header, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			// <object> SP missing LF
+			continue
+		}
+
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected output of git cat-file: %q", header)
+		}
+
+		content := make([]byte, size+1)
+		if _, err := io.ReadFull(reader, content); err != nil {
+			return nil, err
+		}
+
+		contents[fields[0]] = content[:size]
+	}
+
+	return contents, nil
+}
+
+// Diff - changes between two revisions
+func (b *execBackend) Diff(first, second string, paths ...string) ([]FileDiff, error) {
+	args := []string{"-c", "core.quotePath=false", "diff", "-M", "--full-index", "--end-of-options", first, second, "--"}
+	out, err := b.git(append(args, paths...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	files := parseDiff(string(out))
+	for i, file := range files {
+		// renames without changes come without the index line
+		if file.Status == "R" && file.NewBlob == "" {
+			if out, err := b.git("rev-parse", "--verify", "--quiet", "--end-of-options", second+":"+file.NewPath); err == nil {
+				files[i].OldBlob = strings.TrimSpace(string(out))
+				files[i].NewBlob = files[i].OldBlob
+			}
+		}
+
+		if !file.Binary && !file.IsImage() {
+			continue
+		}
+
+		files[i].OldSize = b.blobSize(files[i].OldBlob)
+		files[i].NewSize = b.blobSize(files[i].NewBlob)
+	}
+
+	return files, nil
+}
+
+// blobSize - size of the git object, 0 for missing objects
+func (b *execBackend) blobSize(blob string) int64 {
+	if blob == "" {
+		return 0
+	}
+
+	out, err := b.git("cat-file", "-s", "--end-of-options", blob)
+	if err != nil {
+		log.Error(err)
+		return 0
+	}
+
+	size, _ := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	return size
+}
+
+// Blame - commit which introduced every line of the file at the revision. Git blame accepts --end-of-options
+// only since git 2.43, the revision is resolved first, so one starting with a dash isn't taken for an option.
+func (b *execBackend) Blame(revision, file string) ([]BlameBlock, error) {
+	commit, err := b.RevParse(revision)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := b.git("blame", "--porcelain", commit, "--", file)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseBlame(out), nil
+}
+
+// Renames - files renamed in the history up to the revision
+func (b *execBackend) Renames(revision string) ([]FileRename, error) {
+	out, err := b.git("-c", "core.quotePath=false", "log", "--format=", "-z", "--name-status", "-M", "--diff-filter=R",
+		"--end-of-options", revision, "--")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseRenames(string(out)), nil
+}
+
+// parseRenames - parse git log --name-status -z output of renames: R<score> NUL <old> NUL <new> NUL
+func parseRenames(out string) []FileRename {
+	fields := []string{}
+	for _, field := range strings.Split(out, "\x00") {
+		// commits are separated by line breaks
+		if field = strings.TrimLeft(field, "\n"); field != "" {
+			fields = append(fields, field)
+		}
+	}
+
+	renames := []FileRename{}
+	for i := 0; i+2 < len(fields); i += 3 {
+		if !strings.HasPrefix(fields[i], "R") {
+			log.Errorf("Unexpected output of git log: %q", fields[i])
+			break
+		}
+
+		renames = append(renames, FileRename{OldPath: fields[i+1], NewPath: fields[i+2]})
+	}
+
+	return renames
+}
+
+// RemoteURL - url of the remote repository
+func (b *execBackend) RemoteURL(name string) (string, error) {
+	out, err := b.git("remote", "get-url", "--", name)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
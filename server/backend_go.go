@@ -0,0 +1,1471 @@
+package server
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// diffContext - unchanged lines around the changes, as git diff shows them
+const diffContext = 3
+
+// renameThreshold - files which are similar at least by this percent are renames
+const renameThreshold = 50
+
+// maxRenamePairs - inexact renames are not looked for if there are more deleted and added files pairs
+const maxRenamePairs = 10000
+
+// binaryCheckSize - files with a zero byte in the beginning are binary
+const binaryCheckSize = 8000
+
+// goBackend - backend which reads the repository directly, no git binary is needed
+type goBackend struct {
+	dir     string
+	timeout time.Duration // calls running longer fail with ErrGitTimeout, gitTimeout if zero
+	mx      sync.Mutex
+	repo    *gitRepository
+}
+
+// deadline - context of the call, it's done after the timeout as git commands of the exec backend are killed
+func (b *goBackend) deadline() (context.Context, context.CancelFunc) {
+	timeout := b.timeout
+	if timeout <= 0 {
+		timeout = gitTimeout
+	}
+
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// timedOut - ErrGitTimeout once the context of the call is done
+func timedOut(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ErrGitTimeout
+	}
+
+	return nil
+}
+
+// open - the repository, it's opened on the first use as the docroot may become a repository later
+func (b *goBackend) open() (*gitRepository, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.repo == nil {
+		repo, err := openGitRepository(b.dir)
+		if err != nil {
+			return nil, err
+		}
+
+		b.repo = repo
+	}
+
+	return b.repo, nil
+}
+
+// RevParse - full name of the commit
+func (b *goBackend) RevParse(revision string) (string, error) {
+	repo, err := b.open()
+	if err != nil {
+		return "", err
+	}
+
+	object, err := repo.resolve(revision)
+	if err != nil {
+		return "", err
+	}
+
+	return repo.peel(object, "commit")
+}
+
+// Show - content of the file at the revision
+func (b *goBackend) Show(revision, path string) ([]byte, error) {
+	repo, err := b.open()
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := repo.resolve(revision)
+	if err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		tree, err := repo.peel(object, "tree")
+		if err != nil {
+			return nil, err
+		}
+
+		entry, ok := repo.entry(tree, path)
+		if !ok {
+			return nil, fmt.Errorf("Can't find %s in %s", path, revision)
+		}
+
+		object = entry.Hash
+	}
+
+	return repo.objects.readType(object, objectBlob)
+}
+
+// Tree - all files of the commit
+func (b *goBackend) Tree(commit string) ([]TreeFile, error) {
+	repo, err := b.open()
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := repo.peel(commit, "tree")
+	if err != nil {
+		return nil, err
+	}
+
+	files := []TreeFile{}
+	var walk func(tree, prefix string) error
+	walk = func(tree, prefix string) error {
+		entries, err := repo.tree(tree)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.IsTree() {
+				if err := walk(entry.Hash, prefix+entry.Name+"/"); err != nil {
+					return err
+				}
+			} else if entry.IsBlob() {
+				files = append(files, TreeFile{Path: prefix + entry.Name, Blob: entry.Hash})
+			}
+		}
+
+		return nil
+	}
+
+	return files, walk(tree, "")
+}
+
+// Blobs - content of the objects
+func (b *goBackend) Blobs(names []string) (map[string][]byte, error) {
+	repo, err := b.open()
+	if err != nil {
+		return nil, err
+	}
+
+	contents := make(map[string][]byte)
+	for _, name := range names {
+		data, err := repo.objects.readType(name, objectBlob)
+		if err != nil {
+			return nil, err
+		}
+
+		contents[name] = data
+	}
+
+	return contents, nil
+}
+
+// RemoteURL - url of the remote repository from the config
+func (b *goBackend) RemoteURL(name string) (string, error) {
+	repo, err := b.open()
+	if err != nil {
+		return "", err
+	}
+
+	config, err := repo.config()
+	if err != nil {
+		return "", err
+	}
+
+	url, ok := config["remote."+name+".url"]
+	if !ok {
+		return "", fmt.Errorf("No such remote %s", name)
+	}
+
+	return url, nil
+}
+
+// Log - commits matching the query
+func (b *goBackend) Log(query LogQuery) ([]GitLog, error) {
+	repo, err := b.open()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := b.deadline()
+	defer cancel()
+
+	decorations := repo.decorations()
+	logs := []GitLog{}
+	skip := query.Skip
+	err = b.walk(ctx, repo, query, func(c *gitCommit, files []string) bool {
+		if skip > 0 {
+			skip--
+			return true
+		}
+
+		log := commitLog(c, decorations)
+		log.Files = files
+		logs = append(logs, log)
+		return query.MaxCount <= 0 || len(logs) < query.MaxCount
+	})
+
+	return logs, err
+}
+
+// Count - number of commits matching the query
+func (b *goBackend) Count(query LogQuery) (int, error) {
+	repo, err := b.open()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := b.deadline()
+	defer cancel()
+
+	query.Files = false
+	count := 0
+	err = b.walk(ctx, repo, query, func(*gitCommit, []string) bool {
+		count++
+		return true
+	})
+
+	return count, err
+}
+
+// commitQueue - commits to visit, the most recently committed one goes first as in git log
+type commitQueue struct {
+	commits []*gitCommit
+	order   []int // commits with the same date go in the order they were found
+	next    int
+}
+
+func (q *commitQueue) Len() int { return len(q.commits) }
+
+func (q *commitQueue) Less(i, j int) bool {
+	if ti, tj := q.commits[i].Committer.When, q.commits[j].Committer.When; !ti.Equal(tj) {
+		return ti.After(tj)
+	}
+
+	return q.order[i] < q.order[j]
+}
+
+func (q *commitQueue) Swap(i, j int) {
+	q.commits[i], q.commits[j] = q.commits[j], q.commits[i]
+	q.order[i], q.order[j] = q.order[j], q.order[i]
+}
+
+func (q *commitQueue) Push(x interface{}) {
+	q.commits = append(q.commits, x.(*gitCommit))
+	q.order = append(q.order, q.next)
+	q.next++
+}
+
+func (q *commitQueue) Pop() interface{} {
+	n := len(q.commits) - 1
+	c := q.commits[n]
+	q.commits, q.order = q.commits[:n], q.order[:n]
+	return c
+}
+
+// logFilter - filters of the query which don't depend on the history
+type logFilter struct {
+	author *regexp.Regexp
+	grep   *regexp.Regexp
+	since  time.Time
+	until  time.Time
+}
+
+// newLogFilter - compile regular expressions and parse dates of the query
+func newLogFilter(query LogQuery, now time.Time) (*logFilter, error) {
+	filter := &logFilter{}
+	var err error
+	if query.Author != "" {
+		if filter.author, err = regexp.Compile(query.Author); err != nil {
+			return nil, err
+		}
+	}
+
+	if query.Grep != "" {
+		if filter.grep, err = regexp.Compile("(?i)" + query.Grep); err != nil {
+			return nil, err
+		}
+	}
+
+	if query.Since != "" {
+		if filter.since, err = parseGitDate(query.Since, now); err != nil {
+			return nil, err
+		}
+	}
+
+	if query.Until != "" {
+		if filter.until, err = parseGitDate(query.Until, now); err != nil {
+			return nil, err
+		}
+	}
+
+	return filter, nil
+}
+
+// match - the commit passes all filters, dates are compared with the commit date as git does
+func (f *logFilter) match(c *gitCommit) bool {
+	if f.author != nil && !f.author.MatchString(c.Author.Name+" <"+c.Author.Email+">") {
+		return false
+	}
+
+	if f.grep != nil && !f.grep.MatchString(c.Message) {
+		return false
+	}
+
+	if !f.since.IsZero() && c.Committer.When.Before(f.since) {
+		return false
+	}
+
+	if !f.until.IsZero() && c.Committer.When.After(f.until) {
+		return false
+	}
+
+	return true
+}
+
+// walk - visit commits matching the query newest first until visit returns false, the files are filled if
+// the query asks for them. Merges which don't change the paths are skipped and only the parent with the
+// same paths is followed, as git log does by default. ErrGitTimeout is returned once the context is done.
+func (b *goBackend) walk(ctx context.Context, repo *gitRepository, query LogQuery,
+	visit func(c *gitCommit, files []string) bool) error {
+	filter, err := newLogFilter(query, time.Now())
+	if err != nil {
+		return err
+	}
+
+	paths := []string{}
+	for _, path := range query.Paths {
+		if path = strings.Trim(path, "/"); path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	if query.NoWalk {
+		for _, revision := range query.Revisions {
+			if err := timedOut(ctx); err != nil {
+				return err
+			}
+
+			c, err := b.revisionCommit(repo, revision)
+			if err != nil {
+				return err
+			}
+
+			if filter.match(c) && !visit(c, b.changedFiles(repo, c, paths, query.Files)) {
+				return nil
+			}
+		}
+
+		return nil
+	}
+
+	queue := &commitQueue{}
+	seen := make(map[string]bool)
+	push := func(name string) {
+		if seen[name] {
+			return
+		}
+
+		seen[name] = true
+		// parents of shallow clones are missing
+		if c, err := repo.commit(name); err == nil {
+			heap.Push(queue, c)
+		}
+	}
+
+	for _, revision := range query.Revisions {
+		c, err := b.revisionCommit(repo, revision)
+		if err != nil {
+			return err
+		}
+
+		push(c.Name)
+	}
+
+	for queue.Len() > 0 {
+		if err := timedOut(ctx); err != nil {
+			return err
+		}
+
+		c := heap.Pop(queue).(*gitCommit)
+		parents, show := c.Parents, true
+		current := paths
+		if len(paths) > 0 {
+			parents, show = b.simplify(repo, c, paths)
+			// the file is followed under its old name from the commit which renamed it
+			if query.Follow && len(paths) == 1 && len(parents) == 1 {
+				if old := b.renameSource(ctx, repo, c, parents[0], paths[0]); old != "" {
+					paths = []string{old}
+				}
+			}
+		}
+
+		for _, parent := range parents {
+			push(parent)
+		}
+
+		if !show || !filter.match(c) {
+			continue
+		}
+
+		files := b.changedFiles(repo, c, current, query.Files)
+		if query.Follow && query.Files {
+			files = current
+		}
+
+		if !visit(c, files) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// revisionCommit - commit of the revision of the query
+func (b *goBackend) revisionCommit(repo *gitRepository, revision string) (*gitCommit, error) {
+	object, err := repo.resolve(revision)
+	if err != nil {
+		return nil, err
+	}
+
+	if object, err = repo.peel(object, "commit"); err != nil {
+		return nil, err
+	}
+
+	return repo.commit(object)
+}
+
+// simplify - parents to walk and whether the commit changes the paths, a commit with the same paths as one of
+// its parents is hidden and only that parent is walked
+func (b *goBackend) simplify(repo *gitRepository, c *gitCommit, paths []string) ([]string, bool) {
+	if len(c.Parents) == 0 {
+		for _, path := range paths {
+			if _, ok := repo.entry(c.Tree, path); ok {
+				return nil, true
+			}
+		}
+
+		return nil, false
+	}
+
+	for _, name := range c.Parents {
+		parent, err := repo.commit(name)
+		if err != nil {
+			continue
+		}
+
+		if sameEntries(repo, c.Tree, parent.Tree, paths) {
+			return []string{name}, false
+		}
+	}
+
+	return c.Parents, true
+}
+
+// sameEntries - the paths are the same in both trees
+func sameEntries(repo *gitRepository, a, b string, paths []string) bool {
+	for _, path := range paths {
+		ea, oka := repo.entry(a, path)
+		eb, okb := repo.entry(b, path)
+		if oka != okb || ea.Hash != eb.Hash {
+			return false
+		}
+	}
+
+	return true
+}
+
+// renameSource - old path of the file if the commit created it by renaming another file of the parent
+func (b *goBackend) renameSource(ctx context.Context, repo *gitRepository, c *gitCommit, parentName, path string) string {
+	parent, err := repo.commit(parentName)
+	if err != nil {
+		return ""
+	}
+
+	if _, ok := repo.entry(parent.Tree, path); ok {
+		return ""
+	}
+
+	entry, ok := repo.entry(c.Tree, path)
+	if !ok || !entry.IsBlob() {
+		return ""
+	}
+
+	changes, err := diffTrees(repo, parent.Tree, c.Tree, "")
+	if err != nil {
+		return ""
+	}
+
+	if changes, err = detectRenames(ctx, repo, changes); err != nil {
+		return ""
+	}
+
+	for _, change := range changes {
+		if change.NewPath == path && change.OldPath != "" && change.OldPath != path {
+			return change.OldPath
+		}
+	}
+
+	return ""
+}
+
+// changedFiles - files changed by the commit against its parent limited to the paths, merges come without
+// files as git log shows them
+func (b *goBackend) changedFiles(repo *gitRepository, c *gitCommit, paths []string, fill bool) []string {
+	if !fill || len(c.Parents) > 1 {
+		return nil
+	}
+
+	parentTree := emptyTree
+	if len(c.Parents) == 1 {
+		if parent, err := repo.commit(c.Parents[0]); err == nil {
+			parentTree = parent.Tree
+		}
+	}
+
+	changes, err := diffTrees(repo, parentTree, c.Tree, "")
+	if err != nil {
+		return nil
+	}
+
+	files := []string{}
+	for _, change := range changes {
+		path := change.NewPath
+		if path == "" {
+			path = change.OldPath
+		}
+
+		if matchPaths(path, paths) {
+			files = append(files, path)
+		}
+	}
+
+	return files
+}
+
+// matchPaths - the file is one of the paths or lies in one of the folders, any file matches no paths
+func matchPaths(file string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+
+	for _, path := range paths {
+		if file == path || strings.HasPrefix(file, path+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// commitLog - commit in the form git log of the exec backend returns it
+func commitLog(c *gitCommit, decorations map[string][]string) GitLog {
+	subject, body := splitMessage(c.Message)
+	parents := make([]string, len(c.Parents))
+	for i, parent := range c.Parents {
+		parents[i] = abbreviate(parent)
+	}
+
+	verification := "N"
+	if c.Signed {
+		// signatures can't be checked without gpg
+		verification = "E"
+	}
+
+	return GitLog{
+		Commit:               c.Name,
+		AbbreviatedCommit:    abbreviate(c.Name),
+		Tree:                 c.Tree,
+		AbbreviatedTree:      abbreviate(c.Tree),
+		Parent:               strings.Join(c.Parents, " "),
+		AbbreviatedParent:    strings.Join(parents, " "),
+		Refs:                 strings.Join(decorations[c.Name], ", "),
+		Encoding:             c.Encoding,
+		Subject:              subject,
+		SanitizedSubjectLine: sanitizeSubject(subject),
+		Body:                 body,
+		VerificationFlag:     verification,
+		Author:               GitLogUser{Name: c.Author.Name, Email: c.Author.Email, Date: c.Author.When},
+		Commiter:             GitLogUser{Name: c.Committer.Name, Email: c.Committer.Email, Date: c.Committer.When},
+	}
+}
+
+// abbreviate - short form of the object name
+func abbreviate(name string) string {
+	if len(name) > 7 {
+		return name[:7]
+	}
+
+	return name
+}
+
+// splitMessage - subject is the first paragraph joined into a line, the body is the rest
+func splitMessage(message string) (string, string) {
+	message = strings.TrimLeft(message, "\n")
+	subject, body := message, ""
+	if i := strings.Index(message, "\n\n"); i >= 0 {
+		subject, body = message[:i], strings.TrimLeft(message[i+2:], "\n")
+	}
+
+	lines := strings.Split(strings.TrimSpace(subject), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+
+	return strings.Join(lines, " "), body
+}
+
+// sanitizeSubject - subject suitable for a file name: runs of other characters than letters, digits, dots and
+// underscores become a single dash
+func sanitizeSubject(subject string) string {
+	var out []byte
+	space := 2
+	for i := 0; i < len(subject); i++ {
+		c := subject[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' {
+			if space == 1 {
+				out = append(out, '-')
+			}
+
+			space = 0
+			out = append(out, c)
+			for c == '.' && i+1 < len(subject) && subject[i+1] == '.' {
+				i++
+			}
+		} else {
+			space |= 1
+		}
+	}
+
+	return strings.TrimRight(string(out), ".-")
+}
+
+// relativeDateRe - "2 weeks ago", "3.days.ago"
+var relativeDateRe = regexp.MustCompile(`^(\d+)[ ._]*(second|minute|hour|day|week|month|year)s?[ ._]+ago$`)
+
+// dateLayouts - absolute dates git understands, they are in the local time unless the zone is given
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05Z0700",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04Z0700",
+	"2006-01-02 15:04Z07:00",
+	"2006-01-02 15:04Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006/01/02",
+	"2006.01.02",
+	"Jan 2 2006",
+	"Jan 2, 2006",
+}
+
+// parseGitDate - absolute and relative dates of --since and --until, a date without the time keeps the
+// current time of the day as git does
+func parseGitDate(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	switch strings.ToLower(value) {
+	case "now", "today":
+		return now, nil
+	case "yesterday":
+		return now.AddDate(0, 0, -1), nil
+	}
+
+	if strings.HasPrefix(value, "@") {
+		if sec, err := strconv.ParseInt(value[1:], 10, 64); err == nil {
+			return time.Unix(sec, 0), nil
+		}
+	}
+
+	if m := relativeDateRe.FindStringSubmatch(strings.ToLower(value)); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		switch m[2] {
+		case "second":
+			return now.Add(-time.Duration(n) * time.Second), nil
+		case "minute":
+			return now.Add(-time.Duration(n) * time.Minute), nil
+		case "hour":
+			return now.Add(-time.Duration(n) * time.Hour), nil
+		case "day":
+			return now.AddDate(0, 0, -n), nil
+		case "week":
+			return now.AddDate(0, 0, -7*n), nil
+		case "month":
+			return now.AddDate(0, -n, 0), nil
+		case "year":
+			return now.AddDate(-n, 0, 0), nil
+		}
+	}
+
+	for _, layout := range dateLayouts {
+		t, err := time.ParseInLocation(layout, value, now.Location())
+		if err != nil {
+			continue
+		}
+
+		if !strings.Contains(layout, "15") {
+			t = time.Date(t.Year(), t.Month(), t.Day(), now.Hour(), now.Minute(), now.Second(), 0, now.Location())
+		}
+
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("Can't parse the date %q", value)
+}
+
+// treeChange - file added, deleted, modified or renamed between two trees
+type treeChange struct {
+	OldPath string
+	NewPath string
+	Old     gitTreeEntry // empty for added files
+	New     gitTreeEntry // empty for deleted files
+}
+
+// diffTrees - changed files of two trees, folders with the same object name are skipped
+func diffTrees(repo *gitRepository, a, b, prefix string) ([]treeChange, error) {
+	if a == b {
+		return nil, nil
+	}
+
+	oldEntries, err := repo.tree(a)
+	if err != nil {
+		return nil, err
+	}
+
+	newEntries, err := repo.tree(b)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []treeChange{}
+	add := func(old, new gitTreeEntry) error {
+		switch {
+		case old.IsTree() || new.IsTree():
+			oldTree, newTree := emptyTree, emptyTree
+			if old.IsTree() {
+				oldTree = old.Hash
+			}
+
+			if new.IsTree() {
+				newTree = new.Hash
+			}
+
+			name := old.Name
+			if name == "" {
+				name = new.Name
+			}
+
+			nested, err := diffTrees(repo, oldTree, newTree, prefix+name+"/")
+			if err != nil {
+				return err
+			}
+
+			changes = append(changes, nested...)
+		case old.Hash != new.Hash || old.Mode != new.Mode:
+			change := treeChange{Old: old, New: new}
+			if old.Hash != "" {
+				change.OldPath = prefix + old.Name
+			}
+
+			if new.Hash != "" {
+				change.NewPath = prefix + new.Name
+			}
+
+			changes = append(changes, change)
+		}
+
+		return nil
+	}
+
+	// both trees are sorted, so they are merged like sorted lists
+	i, j := 0, 0
+	for i < len(oldEntries) || j < len(newEntries) {
+		var old, new gitTreeEntry
+		switch {
+		case j >= len(newEntries) || i < len(oldEntries) && treeEntryKey(oldEntries[i]) < treeEntryKey(newEntries[j]):
+			old = oldEntries[i]
+			i++
+		case i >= len(oldEntries) || treeEntryKey(oldEntries[i]) > treeEntryKey(newEntries[j]):
+			new = newEntries[j]
+			j++
+		default:
+			old, new = oldEntries[i], newEntries[j]
+			i++
+			j++
+		}
+
+		// submodules are other repositories
+		if old.Hash != "" && !old.IsTree() && !old.IsBlob() {
+			old = gitTreeEntry{}
+		}
+
+		if new.Hash != "" && !new.IsTree() && !new.IsBlob() {
+			new = gitTreeEntry{}
+		}
+
+		if old.Hash == "" && new.Hash == "" {
+			continue
+		}
+
+		if err := add(old, new); err != nil {
+			return nil, err
+		}
+	}
+
+	return changes, nil
+}
+
+// detectRenames - pair deleted and added files with the same or similar content, comparing the content
+// stops with ErrGitTimeout once the context is done
+func detectRenames(ctx context.Context, repo *gitRepository, changes []treeChange) ([]treeChange, error) {
+	deleted, added := []int{}, []int{}
+	for i, change := range changes {
+		if change.NewPath == "" {
+			deleted = append(deleted, i)
+		} else if change.OldPath == "" {
+			added = append(added, i)
+		}
+	}
+
+	if len(deleted) == 0 || len(added) == 0 {
+		return changes, nil
+	}
+
+	pairs := make(map[int]int) // added -> deleted
+	used := make(map[int]bool)
+	for _, a := range added {
+		for _, d := range deleted {
+			if !used[d] && changes[d].Old.Hash == changes[a].New.Hash {
+				pairs[a], used[d] = d, true
+				break
+			}
+		}
+	}
+
+	if len(deleted)*len(added) <= maxRenamePairs {
+		contents := make(map[string][]byte)
+		read := func(blob string) []byte {
+			if _, ok := contents[blob]; !ok {
+				contents[blob], _ = repo.objects.readType(blob, objectBlob)
+			}
+
+			return contents[blob]
+		}
+
+		for _, a := range added {
+			if _, ok := pairs[a]; ok {
+				continue
+			}
+
+			if err := timedOut(ctx); err != nil {
+				return nil, err
+			}
+
+			best, bestScore := -1, renameThreshold-1
+			for _, d := range deleted {
+				if used[d] {
+					continue
+				}
+
+				if score := similarity(read(changes[d].Old.Hash), read(changes[a].New.Hash)); score > bestScore {
+					best, bestScore = d, score
+				}
+			}
+
+			if best >= 0 {
+				pairs[a], used[best] = best, true
+			}
+		}
+	}
+
+	result := []treeChange{}
+	for i, change := range changes {
+		if used[i] {
+			continue
+		}
+
+		if d, ok := pairs[i]; ok {
+			change.OldPath, change.Old = changes[d].OldPath, changes[d].Old
+		}
+
+		result = append(result, change)
+	}
+
+	return result, nil
+}
+
+// similarity - percent of the content the files share, lines are compared as git compares chunks
+func similarity(a, b []byte) int {
+	longest, shortest := len(a), len(b)
+	if shortest > longest {
+		longest, shortest = shortest, longest
+	}
+
+	if longest == 0 {
+		return 100
+	}
+
+	// the files can't be similar enough if their sizes differ too much
+	if shortest*100 < longest*renameThreshold {
+		return 0
+	}
+
+	lines := make(map[string]int)
+	for _, line := range bytes.SplitAfter(a, []byte("\n")) {
+		lines[string(line)]++
+	}
+
+	common := 0
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if lines[string(line)] > 0 {
+			lines[string(line)]--
+			common += len(line)
+		}
+	}
+
+	return common * 100 / longest
+}
+
+// isBinary - the content has a zero byte in the beginning as git checks it
+func isBinary(data []byte) bool {
+	if len(data) > binaryCheckSize {
+		data = data[:binaryCheckSize]
+	}
+
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+// Diff - changes between two revisions
+func (b *goBackend) Diff(first, second string, paths ...string) ([]FileDiff, error) {
+	repo, err := b.open()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := b.deadline()
+	defer cancel()
+
+	trees := []string{}
+	for _, revision := range []string{first, second} {
+		tree := emptyTree
+		if revision != emptyTree {
+			object, err := repo.resolve(revision)
+			if err != nil {
+				return nil, err
+			}
+
+			if tree, err = repo.peel(object, "tree"); err != nil {
+				return nil, err
+			}
+		}
+
+		trees = append(trees, tree)
+	}
+
+	changes, err := diffTrees(repo, trees[0], trees[1], "")
+	if err != nil {
+		return nil, err
+	}
+
+	limited := []treeChange{}
+	for _, change := range changes {
+		if matchPaths(change.OldPath, paths) && change.OldPath != "" || matchPaths(change.NewPath, paths) && change.NewPath != "" {
+			limited = append(limited, change)
+		}
+	}
+
+	if changes, err = detectRenames(ctx, repo, limited); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changePath(changes[i]) < changePath(changes[j])
+	})
+
+	files := []FileDiff{}
+	for _, change := range changes {
+		if err := timedOut(ctx); err != nil {
+			return nil, err
+		}
+
+		file, err := fileDiff(repo, change)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// changePath - path the change is sorted by
+func changePath(change treeChange) string {
+	if change.NewPath != "" {
+		return change.NewPath
+	}
+
+	return change.OldPath
+}
+
+// fileDiff - diff of the changed file with hunks of changed lines
+func fileDiff(repo *gitRepository, change treeChange) (FileDiff, error) {
+	file := FileDiff{Status: "M", OldPath: change.OldPath, NewPath: change.NewPath, OldBlob: change.Old.Hash, NewBlob: change.New.Hash}
+	switch {
+	case change.OldPath == "":
+		file.Status = "A"
+	case change.NewPath == "":
+		file.Status = "D"
+	case change.OldPath != change.NewPath:
+		file.Status = "R"
+	}
+
+	var old, new []byte
+	var err error
+	if file.OldBlob != "" {
+		if old, err = repo.objects.readType(file.OldBlob, objectBlob); err != nil {
+			return file, err
+		}
+	}
+
+	if file.NewBlob != "" {
+		if new, err = repo.objects.readType(file.NewBlob, objectBlob); err != nil {
+			return file, err
+		}
+	}
+
+	// content of renamed files without changes is not compared
+	if file.OldBlob != file.NewBlob {
+		file.Binary = isBinary(old) || isBinary(new)
+	}
+
+	if file.Binary || file.IsImage() {
+		file.OldSize, file.NewSize = int64(len(old)), int64(len(new))
+	}
+
+	if !file.Binary && file.OldBlob != file.NewBlob {
+		file.Hunks = diffHunks(string(old), string(new))
+	}
+
+	return file, nil
+}
+
+// diffLines - line by line diff of two texts, the last line without the line break differs from the same
+// line with it
+func diffLines(old, new string) []diffmatchpatch.Diff {
+	tokens := newTokenRunes()
+	encode := func(text string) []rune {
+		lines := splitLines(text)
+		if len(lines) > 0 && !strings.HasSuffix(text, "\n") {
+			lines[len(lines)-1] += "\x00"
+		}
+
+		return tokens.encode(lines)
+	}
+
+	dmp := diffmatchpatch.New()
+	return dmp.DiffMainRunes(encode(old), encode(new), false)
+}
+
+// diffHunks - changed lines with diffContext lines around them, close changes share the hunk
+func diffHunks(old, new string) []DiffHunk {
+	oldLines, newLines := splitLines(old), splitLines(new)
+	lines := []DiffLine{}
+	o, n := 0, 0
+	var adds []DiffLine
+	for _, diff := range diffLines(old, new) {
+		for range diff.Text {
+			switch diff.Type {
+			case diffmatchpatch.DiffEqual:
+				// deleted lines go before the added ones of the same change as git shows them
+				lines, adds = append(lines, adds...), nil
+				lines = append(lines, DiffLine{Kind: "context", OldNumber: o + 1, NewNumber: n + 1, Text: newLines[n]})
+				o++
+				n++
+			case diffmatchpatch.DiffDelete:
+				lines = append(lines, DiffLine{Kind: "del", OldNumber: o + 1, Text: oldLines[o]})
+				o++
+			case diffmatchpatch.DiffInsert:
+				adds = append(adds, DiffLine{Kind: "add", NewNumber: n + 1, Text: newLines[n]})
+				n++
+			}
+		}
+	}
+
+	lines = append(lines, adds...)
+
+	hunks := []DiffHunk{}
+	for i := 0; i < len(lines); {
+		if lines[i].Kind == "context" {
+			i++
+			continue
+		}
+
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+
+		// the hunk grows while the next change is close enough for the contexts to meet
+		end := i
+		for j := i; j < len(lines) && j <= end+2*diffContext; j++ {
+			if lines[j].Kind != "context" {
+				end = j
+			}
+		}
+
+		stop := end + diffContext + 1
+		if stop > len(lines) {
+			stop = len(lines)
+		}
+
+		// the hunk starts with a context line unless it's the beginning of the file
+		oldBefore, newBefore := 0, 0
+		if start > 0 {
+			oldBefore, newBefore = lines[start].OldNumber-1, lines[start].NewNumber-1
+		}
+
+		hunks = append(hunks, newDiffHunk(lines[start:stop], oldBefore, newBefore, oldLines))
+		i = stop
+	}
+
+	return hunks
+}
+
+// newDiffHunk - hunk of the lines with the header git writes: "@@ -1,5 +1,6 @@ heading"
+func newDiffHunk(lines []DiffLine, oldBefore, newBefore int, oldLines []string) DiffHunk {
+	oldCount, newCount := 0, 0
+	for _, line := range lines {
+		if line.Kind != "add" {
+			oldCount++
+		}
+
+		if line.Kind != "del" {
+			newCount++
+		}
+	}
+
+	// OldLine and NewLine are the last lines of the hunk as parseDiff leaves them
+	hunk := DiffHunk{OldLine: oldBefore + oldCount, NewLine: newBefore + newCount, Lines: append([]DiffLine{}, lines...)}
+	hunk.Header = fmt.Sprintf("@@ -%s +%s @@", hunkRangeText(oldBefore, oldCount), hunkRangeText(newBefore, newCount))
+	if heading := hunkHeading(oldLines, oldBefore); heading != "" {
+		hunk.Header += " " + heading
+	}
+
+	highlightChanges(hunk.Lines, nil)
+	return hunk
+}
+
+// hunkRangeText - "start,count" of the lines after before, the count is omitted when it's 1 and the start is
+// the line before the hunk when it has no lines
+func hunkRangeText(before, count int) string {
+	start := before + 1
+	if count == 0 {
+		start = before
+	}
+
+	if count == 1 {
+		return strconv.Itoa(start)
+	}
+
+	return strconv.Itoa(start) + "," + strconv.Itoa(count)
+}
+
+// hunkHeading - the closest line before the hunk which starts with a letter, an underscore or a dollar sign,
+// git's default for files without a diff driver
+func hunkHeading(lines []string, before int) string {
+	if before > len(lines) {
+		before = len(lines)
+	}
+
+	for i := before - 1; i >= 0; i-- {
+		line := lines[i]
+		if line == "" {
+			continue
+		}
+
+		if c := line[0]; c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$' {
+			line = strings.TrimRight(line, " \t\r")
+			if len(line) > 80 {
+				line = line[:80]
+			}
+
+			return line
+		}
+	}
+
+	return ""
+}
+
+// Renames - files renamed in the history up to the revision
+func (b *goBackend) Renames(revision string) ([]FileRename, error) {
+	repo, err := b.open()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := b.deadline()
+	defer cancel()
+
+	renames := []FileRename{}
+	var failure error
+	err = b.walk(ctx, repo, LogQuery{Revisions: []string{revision}}, func(c *gitCommit, _ []string) bool {
+		// the first commit has nothing to rename and merges are skipped as git log does
+		if len(c.Parents) != 1 {
+			return true
+		}
+
+		parent, err := repo.commit(c.Parents[0])
+		if err != nil {
+			return true
+		}
+
+		changes, err := diffTrees(repo, parent.Tree, c.Tree, "")
+		if err != nil {
+			failure = err
+			return false
+		}
+
+		if changes, err = detectRenames(ctx, repo, changes); err != nil {
+			failure = err
+			return false
+		}
+
+		sort.SliceStable(changes, func(i, j int) bool {
+			return changePath(changes[i]) < changePath(changes[j])
+		})
+
+		for _, change := range changes {
+			if change.OldPath != "" && change.NewPath != "" && change.OldPath != change.NewPath {
+				renames = append(renames, FileRename{OldPath: change.OldPath, NewPath: change.NewPath})
+			}
+		}
+
+		return true
+	})
+
+	if err == nil {
+		err = failure
+	}
+
+	return renames, err
+}
+
+// blameSuspect - version of the file in a commit, lines which aren't attributed yet are tracked back to the
+// lines of the final version
+type blameSuspect struct {
+	commit *gitCommit
+	path   string
+	blob   string
+	lines  map[int][]int // line of this version -> lines of the final version
+}
+
+// blameQueue - suspects to check, the most recently committed one goes first
+type blameQueue []*blameSuspect
+
+func (q blameQueue) Len() int { return len(q) }
+
+func (q blameQueue) Less(i, j int) bool {
+	return q[i].commit.Committer.When.After(q[j].commit.Committer.When)
+}
+
+func (q blameQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *blameQueue) Push(x interface{}) { *q = append(*q, x.(*blameSuspect)) }
+
+func (q *blameQueue) Pop() interface{} {
+	old := *q
+	s := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return s
+}
+
+// Blame - commit which introduced every line of the file at the revision, lines are passed from a commit to
+// its parents while they are the same there, renames of the whole file are followed
+func (b *goBackend) Blame(revision, file string) ([]BlameBlock, error) {
+	repo, err := b.open()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := b.deadline()
+	defer cancel()
+
+	start, err := b.revisionCommit(repo, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, ok := repo.entry(start.Tree, file)
+	if !ok || !entry.IsBlob() {
+		return nil, fmt.Errorf("Can't find %s in %s", file, revision)
+	}
+
+	content, err := repo.objects.readType(entry.Hash, objectBlob)
+	if err != nil {
+		return nil, err
+	}
+
+	final := splitLines(string(content))
+	owners := make([]*BlameCommit, len(final))
+	commits := make(map[string]*BlameCommit)
+	contents := make(map[string]string)
+	read := func(blob string) string {
+		if _, ok := contents[blob]; !ok {
+			data, _ := repo.objects.readType(blob, objectBlob)
+			contents[blob] = string(data)
+		}
+
+		return contents[blob]
+	}
+
+	queue := &blameQueue{}
+	suspects := make(map[string]*blameSuspect) // commit and path -> suspect waiting in the queue
+	enqueue := func(c *gitCommit, path, blob string, lines map[int][]int) {
+		key := c.Name + "\x00" + path
+		if s, ok := suspects[key]; ok {
+			for line, targets := range lines {
+				s.lines[line] = append(s.lines[line], targets...)
+			}
+
+			return
+		}
+
+		s := &blameSuspect{commit: c, path: path, blob: blob, lines: lines}
+		suspects[key] = s
+		heap.Push(queue, s)
+	}
+
+	lines := make(map[int][]int)
+	for i := range final {
+		lines[i] = []int{i}
+	}
+
+	enqueue(start, file, entry.Hash, lines)
+	for queue.Len() > 0 {
+		if err := timedOut(ctx); err != nil {
+			return nil, err
+		}
+
+		s := heap.Pop(queue).(*blameSuspect)
+		delete(suspects, s.commit.Name+"\x00"+s.path)
+
+		prevCommit, prevPath := emptyTree, s.path
+		for i, name := range s.commit.Parents {
+			if len(s.lines) == 0 {
+				break
+			}
+
+			parent, err := repo.commit(name)
+			if err != nil {
+				continue
+			}
+
+			path := s.path
+			parentEntry, ok := repo.entry(parent.Tree, path)
+			if !ok && len(s.commit.Parents) == 1 {
+				if path = b.renameSource(ctx, repo, s.commit, name, s.path); path != "" {
+					parentEntry, ok = repo.entry(parent.Tree, path)
+				}
+			}
+
+			if !ok || !parentEntry.IsBlob() {
+				continue
+			}
+
+			if i == 0 || prevCommit == emptyTree {
+				prevCommit, prevPath = name, path
+			}
+
+			// the same file, everything is passed to the parent
+			if parentEntry.Hash == s.blob {
+				enqueue(parent, path, parentEntry.Hash, s.lines)
+				s.lines = map[int][]int{}
+				break
+			}
+
+			passed := make(map[int][]int)
+			o, n := 0, 0
+			for _, diff := range diffLines(read(parentEntry.Hash), read(s.blob)) {
+				for range diff.Text {
+					switch diff.Type {
+					case diffmatchpatch.DiffEqual:
+						if targets, ok := s.lines[n]; ok {
+							passed[o] = targets
+							delete(s.lines, n)
+						}
+
+						o++
+						n++
+					case diffmatchpatch.DiffDelete:
+						o++
+					case diffmatchpatch.DiffInsert:
+						n++
+					}
+				}
+			}
+
+			if len(passed) > 0 {
+				enqueue(parent, path, parentEntry.Hash, passed)
+			}
+		}
+
+		if len(s.lines) == 0 {
+			continue
+		}
+
+		commit, ok := commits[s.commit.Name]
+		if !ok {
+			subject, _ := splitMessage(s.commit.Message)
+			commit = &BlameCommit{
+				Commit:       s.commit.Name,
+				Author:       s.commit.Author.Name,
+				AuthorMail:   s.commit.Author.Email,
+				Date:         time.Unix(s.commit.Author.When.Unix(), 0),
+				Subject:      subject,
+				Filename:     s.path,
+				PrevCommit:   prevCommit,
+				PrevFilename: prevPath,
+			}
+			commits[s.commit.Name] = commit
+		}
+
+		for _, targets := range s.lines {
+			for _, target := range targets {
+				owners[target] = commit
+			}
+		}
+	}
+
+	blocks := []BlameBlock{}
+	for i, owner := range owners {
+		if owner == nil {
+			continue
+		}
+
+		line := BlameLine{Number: i + 1, Text: final[i]}
+		if len(blocks) > 0 && blocks[len(blocks)-1].Commit == owner {
+			blocks[len(blocks)-1].Lines = append(blocks[len(blocks)-1].Lines, line)
+		} else {
+			blocks = append(blocks, BlameBlock{Commit: owner, Lines: []BlameLine{line}})
+		}
+	}
+
+	return blocks, nil
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logSummary - fields of the commit both backends fill
+func logSummary(logs []GitLog) []string {
+	summary := []string{}
+	for _, l := range logs {
+		summary = append(summary, fmt.Sprintf("%s %s %s %s %q %q %q %q %s %s %s %s %v %s",
+			l.Commit, l.AbbreviatedCommit, l.Tree, l.Parent, l.Refs, l.Subject, l.SanitizedSubjectLine, l.Body,
+			l.Author.Name, l.Author.Email, l.Author.Date.Format(time.RFC3339), l.Commiter.Date.Format(time.RFC3339),
+			l.Files, l.VerificationFlag))
+	}
+
+	return summary
+}
+
+// blameSummary - lines of the file with their commits
+func blameSummary(blocks []BlameBlock) []string {
+	summary := []string{}
+	for _, block := range blocks {
+		c := block.Commit
+		for _, line := range block.Lines {
+			summary = append(summary, fmt.Sprintf("%d %q %s %s %s %d %q %s %s %s", line.Number, line.Text,
+				c.Commit, c.Author, c.AuthorMail, c.Date.Unix(), c.Subject, c.Filename, c.PrevCommit, c.PrevFilename))
+		}
+	}
+
+	return summary
+}
+
+func TestGoBackend(t *testing.T) {
+	gitDir := fixtureRepo(t)
+	native := newGitBackend(gitDir, GitBackendGo)
+	git := newGitBackend(gitDir, GitBackendExec)
+
+	for _, revision := range []string{"HEAD", "master", "v1", "v2", "tags/v1", "HEAD~1", "HEAD~1^2", "HEAD^^2~1", "feature", "origin"} {
+		expected, expectedErr := git.RevParse(revision)
+		got, err := native.RevParse(revision)
+		if got != expected || (err == nil) != (expectedErr == nil) {
+			t.Errorf("RevParse(%q): expected %q, %v, got %q, %v", revision, expected, expectedErr, got, err)
+		}
+	}
+
+	head, _ := git.RevParse("HEAD")
+	if got, err := native.RevParse(head[:8]); got != head || err != nil {
+		t.Errorf("RevParse of the abbreviated name: expected %q, got %q, %v", head, got, err)
+	}
+
+	queries := []LogQuery{
+		{Revisions: []string{"HEAD"}},
+		{Revisions: []string{"HEAD"}, Files: true},
+		{Revisions: []string{"HEAD"}, Paths: []string{"runbooks"}, Files: true},
+		{Revisions: []string{"HEAD"}, Paths: []string{"Home.md"}},
+		{Revisions: []string{"HEAD"}, Paths: []string{"runbooks/notes.md"}, Follow: true, Files: true},
+		{Revisions: []string{"HEAD"}, Author: "ann@", Skip: 1, MaxCount: 2},
+		{Revisions: []string{"HEAD"}, Grep: "EDIT"},
+		{Revisions: []string{"HEAD"}, Since: "2024-01-03T12:00:00+02:00", Until: "2024-01-06T09:00:00+02:00"},
+		{Revisions: []string{"HEAD"}, Since: "2024-01-02 12:00+02:00", Until: "2024-01-05T12:00Z"},
+		{Revisions: []string{"HEAD"}, Until: "2024-01-05 09:00+0200"},
+		{Revisions: []string{"v1", "feature"}, NoWalk: true},
+	}
+
+	for _, query := range queries {
+		expected, err := git.Log(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := native.Log(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if e, g := logSummary(expected), logSummary(got); !reflect.DeepEqual(e, g) {
+			t.Errorf("Log(%+v):\nexpected %q\ngot      %q", query, e, g)
+		}
+
+		if query.NoWalk || query.Follow {
+			continue
+		}
+
+		expectedCount, _ := git.Count(query)
+		if count, err := native.Count(query); count != expectedCount || err != nil {
+			t.Errorf("Count(%+v): expected %d, got %d, %v", query, expectedCount, count, err)
+		}
+	}
+
+	for _, file := range [][2]string{{"HEAD", "Start.md"}, {"v1", "runbooks/notes.md"}, {"HEAD~2", "logo.png"}} {
+		expected, _ := git.Show(file[0], file[1])
+		if got, err := native.Show(file[0], file[1]); string(got) != string(expected) || err != nil {
+			t.Errorf("Show(%q, %q): expected %q, got %q, %v", file[0], file[1], expected, got, err)
+		}
+	}
+
+	expectedTree, _ := git.Tree(head)
+	if tree, err := native.Tree(head); !reflect.DeepEqual(tree, expectedTree) || err != nil {
+		t.Errorf("Tree: expected %+v, got %+v, %v", expectedTree, tree, err)
+	}
+
+	commits, _ := git.Log(LogQuery{Revisions: []string{"HEAD"}})
+	for _, commit := range commits {
+		parent := emptyTree
+		if parents := strings.Fields(commit.Parent); len(parents) > 0 {
+			parent = parents[0]
+		}
+
+		expected, _ := git.Diff(parent, commit.Commit)
+		if got, err := native.Diff(parent, commit.Commit); !reflect.DeepEqual(got, expected) || err != nil {
+			t.Errorf("Diff of %s:\nexpected %+v\ngot      %+v, %v", commit.Subject, expected, got, err)
+		}
+	}
+
+	expectedDiff, _ := git.Diff("v1", "HEAD", "runbooks")
+	if got, err := native.Diff("v1", "HEAD", "runbooks"); !reflect.DeepEqual(got, expectedDiff) || err != nil {
+		t.Errorf("Diff of the folder:\nexpected %+v\ngot      %+v, %v", expectedDiff, got, err)
+	}
+
+	for _, file := range []string{"Start.md", "runbooks/notes.md", "runbooks/database.md"} {
+		expected, _ := git.Blame("HEAD", file)
+		got, err := native.Blame("HEAD", file)
+		if e, g := blameSummary(expected), blameSummary(got); !reflect.DeepEqual(e, g) || err != nil {
+			t.Errorf("Blame(%q):\nexpected %q\ngot      %q, %v", file, e, g, err)
+		}
+	}
+
+	// revisions from the url are never taken for options of git, --contents would read any file
+	if blocks, err := git.Blame("--contents="+filepath.Join(gitDir, "HEAD"), "Start.md"); err == nil {
+		t.Errorf("Blame: expected an unknown revision, got %q", blameSummary(blocks))
+	}
+
+	expectedRenames, _ := git.Renames("HEAD")
+	if renames, err := native.Renames("HEAD"); !reflect.DeepEqual(renames, expectedRenames) || len(renames) == 0 || err != nil {
+		t.Errorf("Renames: expected %+v, got %+v, %v", expectedRenames, renames, err)
+	}
+
+	expectedURL, _ := git.RemoteURL("origin")
+	if url, err := native.RemoteURL("origin"); url != expectedURL || err != nil {
+		t.Errorf("RemoteURL: expected %q, got %q, %v", expectedURL, url, err)
+	}
+}
+
+func TestAutoBackend(t *testing.T) {
+	gitDir := fixtureRepo(t)
+	if err := os.Rename(gitDir, gitDir+".cloning"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the mirror clones the repository after the backend is created
+	backend, ok := newGitBackend(gitDir, GitBackendAuto).(*autoBackend)
+	if !ok {
+		t.Fatalf("expected the backend to be picked later")
+	}
+
+	if _, err := backend.RevParse("HEAD"); err == nil {
+		t.Error("expected an error for the missing repository")
+	}
+
+	if err := os.Rename(gitDir+".cloning", gitDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backend.RevParse("HEAD"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := backend.backend.(*goBackend); !ok {
+		t.Errorf("expected the repository to be read directly, got %T", backend.backend)
+	}
+}
+
+func TestParseGitDate(t *testing.T) {
+	now := time.Date(2024, 3, 10, 15, 4, 5, 0, time.UTC)
+	tests := map[string]time.Time{
+		"2 weeks ago":               now.AddDate(0, 0, -14),
+		"3.days.ago":                now.AddDate(0, 0, -3),
+		"yesterday":                 now.AddDate(0, 0, -1),
+		"2024-01-02":                time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC),
+		"2024-01-02 10:00":          time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC),
+		"2024-01-02T10:00:00+02:00": time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC),
+		"2024-01-02 10:00+02:00":    time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC),
+		"2024-01-02T10:00Z":         time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC),
+		"2024-01-02 10:00:00+0200":  time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC),
+		"@1700000000":               time.Unix(1700000000, 0),
+	}
+
+	for value, expected := range tests {
+		if got, err := parseGitDate(value, now); !got.Equal(expected) || err != nil {
+			t.Errorf("parseGitDate(%q): expected %v, got %v, %v", value, expected, got, err)
+		}
+	}
+
+	if _, err := parseGitDate("next tuesday-ish", now); err == nil {
+		t.Error("expected an error for the unknown date")
+	}
+}
+
+func TestGoBackendTimeout(t *testing.T) {
+	gitDir := fixtureRepo(t)
+	native := &goBackend{dir: gitDir, timeout: time.Nanosecond}
+
+	if _, err := native.Log(LogQuery{Revisions: []string{"HEAD"}, Files: true}); err != ErrGitTimeout {
+		t.Errorf("Log: expected the timeout, got %v", err)
+	}
+
+	if _, err := native.Count(LogQuery{Revisions: []string{"HEAD"}}); err != ErrGitTimeout {
+		t.Errorf("Count: expected the timeout, got %v", err)
+	}
+
+	if _, err := native.Renames("HEAD"); err != ErrGitTimeout {
+		t.Errorf("Renames: expected the timeout, got %v", err)
+	}
+
+	if _, err := native.Diff("v1", "HEAD"); err != ErrGitTimeout {
+		t.Errorf("Diff: expected the timeout, got %v", err)
+	}
+
+	if _, err := native.Blame("HEAD", "runbooks/notes.md"); err != ErrGitTimeout {
+		t.Errorf("Blame: expected the timeout, got %v", err)
+	}
+
+	// reading single objects is not limited
+	if _, err := native.Show("HEAD", "Start.md"); err != nil {
+		t.Errorf("Show: %v", err)
+	}
+}
+
+func TestParseGitLog(t *testing.T) {
+	record := func(commit, subject, body, date string) string {
+		fields := []string{"\x1e" + commit, commit[:7], emptyTree, emptyTree[:7], "", "", "HEAD -> master", "",
+			subject, "subject", body, "", "N", "", "", "Ann", "ann@example.com", date, "Ann", "ann@example.com", date}
+		return strings.Join(fields, "\x00") + "\x00\n"
+	}
+
+	first := strings.Repeat("a", 40)
+	second := strings.Repeat("b", 40)
+	out := record(first, `Quote " and \ backslash`, "Body\nwith {\"json\"}\n", "2024-01-02T10:00:00+02:00") +
+		record(strings.Repeat("c", 40), "Broken date", "", "yesterday") +
+		record(second, "Second", "", "2024-01-01T10:00:00Z")
+
+	logs := parseGitLog(out)
+	if len(logs) != 2 || logs[0].Commit != first || logs[1].Commit != second {
+		t.Fatalf("unexpected commits: %+v", logs)
+	}
+
+	if logs[0].Subject != `Quote " and \ backslash` || logs[0].Body != "Body\nwith {\"json\"}\n" {
+		t.Errorf("unexpected message: %q %q", logs[0].Subject, logs[0].Body)
+	}
+
+	if logs[0].Refs != "HEAD -> master" || logs[0].Author.Date.Day() != 2 {
+		t.Errorf("unexpected commit: %+v", logs[0])
+	}
+
+	// output cut in the middle of a commit
+	if logs := parseGitLog(out[:len(out)-20]); len(logs) != 1 {
+		t.Errorf("expected the complete commit only, got %+v", logs)
+	}
+}
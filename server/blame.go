@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlameCommit - commit which introduced lines of the file
+type BlameCommit struct {
+	Commit       string
+	Author       string
+	AuthorMail   string
+	Date         time.Time
+	Subject      string
+	Filename     string // path of the file in this commit
+	PrevCommit   string // parent commit, empty tree in case of the first commit of the file
+	PrevFilename string // path of the file in the parent commit
+}
+
+// AbbreviatedCommit - short form of the commit hash
+func (c *BlameCommit) AbbreviatedCommit() string {
+	if len(c.Commit) > 7 {
+		return c.Commit[:7]
+	}
+
+	return c.Commit
+}
+
+// BlameLine - line of the file
+type BlameLine struct {
+	Number int
+	Text   string
+}
+
+// BlameBlock - consecutive lines of the file introduced by the same commit
+type BlameBlock struct {
+	Commit *BlameCommit
+	Lines  []BlameLine
+}
+
+// parseBlame - parse output of git blame --porcelain into blocks of lines
+func parseBlame(out []byte) []BlameBlock {
+	commits := make(map[string]*BlameCommit)
+	blocks := []BlameBlock{}
+	var current *BlameCommit
+	var number int
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// content of the line goes last after all headers
+		if strings.HasPrefix(line, "\t") {
+			if current == nil {
+				continue
+			}
+
+			blameLine := BlameLine{Number: number, Text: line[1:]}
+			if len(blocks) > 0 && blocks[len(blocks)-1].Commit == current {
+				blocks[len(blocks)-1].Lines = append(blocks[len(blocks)-1].Lines, blameLine)
+			} else {
+				blocks = append(blocks, BlameBlock{Commit: current, Lines: []BlameLine{blameLine}})
+			}
+
+			continue
+		}
+
+		// header of the line: <sha> <original line> <final line> [<lines in group>]
+		if fields := strings.Fields(line); len(fields) >= 3 && isObjectName(fields[0]) {
+			number, _ = strconv.Atoi(fields[2])
+			if commits[fields[0]] == nil {
+				commits[fields[0]] = &BlameCommit{Commit: fields[0], PrevCommit: emptyTree}
+			}
+
+			current = commits[fields[0]]
+			continue
+		}
+
+		if current == nil {
+			continue
+		}
+
+		key, value := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			key, value = line[:i], line[i+1:]
+		}
+
+		switch key {
+		case "author":
+			current.Author = value
+		case "author-mail":
+			current.AuthorMail = strings.Trim(value, "<>")
+		case "author-time":
+			if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+				current.Date = time.Unix(sec, 0)
+			}
+		case "summary":
+			current.Subject = value
+		case "filename":
+			current.Filename = value
+			if current.PrevFilename == "" {
+				current.PrevFilename = value
+			}
+		case "previous":
+			if fields := strings.SplitN(value, " ", 2); len(fields) == 2 {
+				current.PrevCommit, current.PrevFilename = fields[0], fields[1]
+			}
+		}
+	}
+
+	return blocks
+}
+
+// isObjectName - check if the string is a full hexadecimal object name
+func isObjectName(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,29 @@
+package server
+
+import "testing"
+
+func TestParseBlame(t *testing.T) {
+	out := "4ae7ba7705c1b5f7459bda533a71c930f4898663 1 1 2\n" +
+		"author Ann Author\nauthor-mail <ann@example.com>\nauthor-time 1792308047\nauthor-tz +0000\n" +
+		"summary init\nboundary\nfilename runbooks/notes.md\n\t# Runbook notes\n" +
+		"4ae7ba7705c1b5f7459bda533a71c930f4898663 2 2\n\t\n" +
+		"45e722a4e42544dfc0c50235e456fb5edf305272 2 3 1\n" +
+		"author Bob\nauthor-mail <bob@example.com>\nauthor-time 1792308567\nauthor-tz +0000\n" +
+		"summary update notes\nprevious 75acecc505c59728307e25e9f02532d5265bac83 runbooks/notes.md\n" +
+		"filename runbooks/runbook-notes.md\n\tmore\n"
+
+	blocks := parseBlame([]byte(out))
+	if len(blocks) != 2 || len(blocks[0].Lines) != 2 || blocks[1].Lines[0].Number != 3 {
+		t.Fatalf("unexpected blocks: %+v", blocks)
+	}
+
+	first, second := blocks[0].Commit, blocks[1].Commit
+	if first.Author != "Ann Author" || first.PrevCommit != emptyTree || first.Subject != "init" {
+		t.Errorf("unexpected first commit: %+v", first)
+	}
+
+	if second.PrevCommit != "75acecc505c59728307e25e9f02532d5265bac83" || second.PrevFilename != "runbooks/notes.md" ||
+		second.Filename != "runbooks/runbook-notes.md" || second.AuthorMail != "bob@example.com" {
+		t.Errorf("unexpected second commit: %+v", second)
+	}
+}
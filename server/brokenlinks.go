@@ -0,0 +1,71 @@
+package server
+
+import (
+	"regexp"
+	"sort"
+)
+
+// anchorRe - targets of #anchor links: heading anchors and elements with id
+var anchorRe = regexp.MustCompile(`\s(?:name|id)="([^"]*)"`)
+
+// BrokenLink - link which points to nothing
+type BrokenLink struct {
+	Target string `json:"target"` // url of the link
+	Reason string `json:"reason"`
+}
+
+// BrokenLinks - broken links of a single page
+type BrokenLinks struct {
+	Page  PageRef      `json:"page"`
+	Links []BrokenLink `json:"links"`
+}
+
+// buildBrokenLinks - find links to missing pages, anchors and attachments grouped by the page
+func buildBrokenLinks(pages map[string]*Page) []BrokenLinks {
+	anchors := make(map[string]map[string]bool)
+	for key, page := range pages {
+		anchors[key] = make(map[string]bool)
+		for _, match := range anchorRe.FindAllStringSubmatch(string(page.Content), -1) {
+			anchors[key][match[1]] = true
+		}
+	}
+
+	report := []BrokenLinks{}
+	for key, page := range pages {
+		var broken []BrokenLink
+		seen := make(map[PageLink]bool)
+		for _, link := range page.Links {
+			if seen[link] {
+				continue
+			}
+
+			seen[link] = true
+			reason := ""
+			switch {
+			case !link.IsFound && link.IsAttachment:
+				reason = "missing attachment"
+			case !link.IsFound:
+				reason = "missing page"
+			case !link.IsAttachment && link.Fragment != "" && anchors[link.Key] != nil && !anchors[link.Key][link.Fragment]:
+				reason = "missing anchor"
+			default:
+				continue
+			}
+
+			broken = append(broken, BrokenLink{Target: link.URL(), Reason: reason})
+		}
+
+		if len(broken) > 0 {
+			report = append(report, BrokenLinks{
+				Page:  PageRef{Key: key, Title: page.Title, URL: pageURL(key, "")},
+				Links: broken,
+			})
+		}
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Page.Key < report[j].Page.Key
+	})
+
+	return report
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildBrokenLinks(t *testing.T) {
+	r := NewRenderer(writeDocroot(t, map[string]string{
+		"Home.md": "# Home\n\n[DB](runbooks/db.md#restore) [Gone](runbooks/db.md#gone) [Missing](missing.md) " +
+			"[Logo](logo.png) [Report](files/report.pdf) [Top](#home) [Nothing](#nothing) [[Nowhere]]\n",
+		"runbooks/db.md": "# DB\n\n## Restore\n\n[Home](../Home.md) [Home again](../Home.md) [Report](/files/report.pdf)\n",
+		"notes.md":       "# Notes\n\n[DB](runbooks/db)\n",
+		"logo.png":       "\x89PNG",
+	}), make(chan interface{}, 1))
+	r.scanStorage()
+
+	expected := []BrokenLinks{
+		{
+			Page: PageRef{Key: "/", Title: "Home", URL: "/"},
+			Links: []BrokenLink{
+				{Target: "/runbooks/db#gone", Reason: "missing anchor"},
+				{Target: "/missing", Reason: "missing page"},
+				{Target: "/files/report.pdf", Reason: "missing attachment"},
+				{Target: "/#nothing", Reason: "missing anchor"},
+				{Target: "/Nowhere", Reason: "missing page"},
+			},
+		},
+		{
+			Page:  PageRef{Key: "runbooks/db", Title: "DB", URL: "/runbooks/db"},
+			Links: []BrokenLink{{Target: "/files/report.pdf", Reason: "missing attachment"}},
+		},
+	}
+
+	if report := r.GetBrokenLinks(); !reflect.DeepEqual(report, expected) {
+		t.Errorf("expected %+v, got %+v", expected, report)
+	}
+}
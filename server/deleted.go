@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DeletedPage - markdown file which existed in the history but is gone from the tree
+type DeletedPage struct {
+	Path   string  // path of the file relative to the docroot
+	Commit *GitLog // commit which deleted the file
+}
+
+// Title - name of the file without the extension
+func (p DeletedPage) Title() string {
+	return strings.TrimSuffix(path.Base(p.Path), path.Ext(p.Path))
+}
+
+// URL - url of the last version of the page
+func (p DeletedPage) URL() string {
+	return "/_deleted/" + (&url.URL{Path: p.Path}).EscapedPath()
+}
+
+// deletedPages - markdown files of the history which are not in the tree, the last commit which changed such
+// a file deleted it. Renamed pages are left out, their old urls lead to the new names. Nothing is known
+// to be deleted without the tree.
+func deletedPages(stats map[string]*fileStat, tree map[string]bool, redirects map[string]string) []DeletedPage {
+	deleted := []DeletedPage{}
+	if tree == nil {
+		return deleted
+	}
+
+	for file, stat := range stats {
+		key := pageKey(file)
+		if key == "" || tree[file] || isHiddenPath(file) || stat.LastCommit == nil {
+			continue
+		}
+
+		if _, ok := redirects[key]; ok {
+			continue
+		}
+
+		deleted = append(deleted, DeletedPage{Path: file, Commit: stat.LastCommit})
+	}
+
+	// recently deleted pages go first
+	sort.Slice(deleted, func(i, j int) bool {
+		ti, tj := deleted[i].Commit.Commiter.Date, deleted[j].Commit.Commiter.Date
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+
+		return deleted[i].Path < deleted[j].Path
+	})
+
+	return deleted
+}
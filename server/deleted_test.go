@@ -0,0 +1,71 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeletedPages(t *testing.T) {
+	commit := func(sha, date string) *GitLog {
+		when, _ := time.Parse(time.RFC3339, date)
+		return &GitLog{Commit: sha, Commiter: GitLogUser{Date: when}}
+	}
+
+	stats := map[string]*fileStat{
+		"Home.md":          {LastCommit: commit("a1", "2024-01-01T10:00:00Z")},
+		"old.md":           {LastCommit: commit("b2", "2024-01-02T10:00:00Z")},
+		"runbooks/db.md":   {LastCommit: commit("c3", "2024-01-03T10:00:00Z")},
+		"drafts/ideas.md":  {LastCommit: commit("d4", "2024-01-04T10:00:00Z")},
+		"logo.png":         {LastCommit: commit("e5", "2024-01-05T10:00:00Z")},
+		".github/notes.md": {LastCommit: commit("f6", "2024-01-06T10:00:00Z")},
+	}
+
+	tree := map[string]bool{"Home.md": true, "runbooks/database.md": true}
+	redirects := map[string]string{"runbooks/db": "runbooks/database"}
+
+	deleted := deletedPages(stats, tree, redirects)
+	if len(deleted) != 2 {
+		t.Fatalf("expected 2 deleted pages, got %+v", deleted)
+	}
+
+	if deleted[0].Path != "drafts/ideas.md" || deleted[1].Path != "old.md" {
+		t.Errorf("unexpected deleted pages: %+v", deleted)
+	}
+
+	if page := deleted[0]; page.Title() != "ideas" || page.URL() != "/_deleted/drafts/ideas.md" {
+		t.Errorf("unexpected title or url: %q, %q", page.Title(), page.URL())
+	}
+
+	if deleted := deletedPages(stats, nil, redirects); len(deleted) != 0 {
+		t.Errorf("expected no deleted pages without the tree, got %+v", deleted)
+	}
+}
+
+func TestGetDeletedPage(t *testing.T) {
+	r := NewRenderer(filepath.Dir(fixtureRepo(t)), make(chan interface{}, 1))
+	r.scanStorage()
+
+	deleted := r.GetDeletedPages()
+	if len(deleted) != 1 || deleted[0].Path != "drafts.md" || deleted[0].Commit.Author.Name != "Carl" {
+		t.Fatalf("unexpected deleted pages: %+v", deleted)
+	}
+
+	page, err := r.GetDeletedPage("drafts.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if page.Deleted == nil || page.Deleted.Commit.Subject != "Drop the drafts" {
+		t.Errorf("unexpected deleted page: %+v", page.Deleted)
+	}
+
+	if !strings.Contains(string(page.Content.Content), "Ideas for the") || page.Content.EditLink != "" {
+		t.Errorf("unexpected last version: %+v", page.Content)
+	}
+
+	if _, err := r.GetDeletedPage("Start.md"); err == nil {
+		t.Error("expected an error for the existing page")
+	}
+}
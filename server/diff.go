@@ -0,0 +1,585 @@
+package server
+
+import (
+	"html/template"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"github.com/shurcooL/highlight_go"
+	"github.com/sourcegraph/annotate"
+	"github.com/sourcegraph/syntaxhighlight"
+)
+
+// Layouts of the rendered diff
+const (
+	DiffInline = "inline"
+	DiffSplit  = "split"
+)
+
+// ChangedFile - file changed by the commit
+type ChangedFile struct {
+	Status  string    // A, M, D, R, C or T as git reports it
+	Path    string    // path of the file after the commit
+	OldPath string    // path of the file before the commit
+	Diff    *FileDiff // diff of markdown files and images
+	PageURL string    // url of the page at this commit, empty for files which are not pages
+}
+
+// StatusName - human readable status of the change
+func (f ChangedFile) StatusName() string {
+	return statusName(f.Status)
+}
+
+// imageExtensions - files shown as images in the diff
+var imageExtensions = map[string]bool{
+	".png":  true,
+	".jpg":  true,
+	".jpeg": true,
+	".gif":  true,
+	".svg":  true,
+}
+
+// FileDiff - parsed diff of a single file
+type FileDiff struct {
+	Status  string // A, M, D or R
+	OldPath string
+	NewPath string
+	OldBlob string // object name of the file before the change, empty for added files
+	NewBlob string // object name of the file after the change, empty for deleted files
+	OldSize int64  // sizes are filled for images and binary files only
+	NewSize int64
+	Binary  bool
+	Hunks   []DiffHunk
+}
+
+// IsImage - the file is an image, so both versions are shown instead of the text diff
+func (f FileDiff) IsImage() bool {
+	return isImageFile(f.Path())
+}
+
+// isImageFile - the file has one of image extensions
+func isImageFile(name string) bool {
+	return imageExtensions[strings.ToLower(path.Ext(name))]
+}
+
+// OldURL - url of the file before the change
+func (f FileDiff) OldURL() string {
+	return blobURL(f.OldBlob, f.OldPath)
+}
+
+// NewURL - url of the file after the change
+func (f FileDiff) NewURL() string {
+	return blobURL(f.NewBlob, f.NewPath)
+}
+
+// OldSizeText - human readable size of the file before the change
+func (f FileDiff) OldSizeText() string {
+	return sizeText(f.OldSize)
+}
+
+// NewSizeText - human readable size of the file after the change
+func (f FileDiff) NewSizeText() string {
+	return sizeText(f.NewSize)
+}
+
+// sizeText - size in bytes, kilobytes or megabytes
+func sizeText(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return strconv.FormatFloat(float64(size)/(1<<20), 'f', 1, 64) + " MB"
+	case size >= 1<<10:
+		return strconv.FormatFloat(float64(size)/(1<<10), 'f', 1, 64) + " KB"
+	}
+
+	return strconv.FormatInt(size, 10) + " bytes"
+}
+
+// blobURL - url of the git object, the name of the file gives the content type
+func blobURL(blob, file string) string {
+	if blob == "" {
+		return ""
+	}
+
+	return "/_blob/" + blob + "/" + url.PathEscape(path.Base(file))
+}
+
+// Path - path of the file after the change, the old one for deleted files
+func (f FileDiff) Path() string {
+	if f.NewPath == "" {
+		return f.OldPath
+	}
+
+	return f.NewPath
+}
+
+// StatusName - human readable status of the change
+func (f FileDiff) StatusName() string {
+	return statusName(f.Status)
+}
+
+// DiffHunk - block of changed lines with some context around
+type DiffHunk struct {
+	Header  string // "@@ -1,5 +1,6 @@" line, usually with the enclosing heading
+	OldLine int
+	NewLine int
+	Lines   []DiffLine
+}
+
+// DiffLine - line of the hunk
+type DiffLine struct {
+	Kind      string        // context, add or del
+	OldNumber int           // 0 for added lines
+	NewNumber int           // 0 for deleted lines
+	Text      string        // text of the line without the +/- marker
+	HTML      template.HTML // escaped text, code tokens are highlighted, changed words are wrapped into <del> and <ins>
+}
+
+// DiffRow - row of the side by side diff, one of the sides is nil when the line has no pair
+type DiffRow struct {
+	Old *DiffLine
+	New *DiffLine
+}
+
+// Rows - lines of the hunk paired for the side by side layout
+func (h DiffHunk) Rows() []DiffRow {
+	rows := []DiffRow{}
+	for i := 0; i < len(h.Lines); {
+		if h.Lines[i].Kind == "context" {
+			rows = append(rows, DiffRow{Old: &h.Lines[i], New: &h.Lines[i]})
+			i++
+			continue
+		}
+
+		dels, adds := changeBlock(h.Lines, i)
+		for j := 0; j < len(dels) || j < len(adds); j++ {
+			row := DiffRow{}
+			if j < len(dels) {
+				row.Old = &h.Lines[dels[j]]
+			}
+
+			if j < len(adds) {
+				row.New = &h.Lines[adds[j]]
+			}
+
+			rows = append(rows, row)
+		}
+
+		i += len(dels) + len(adds)
+	}
+
+	return rows
+}
+
+// changeBlock - indexes of deleted and added lines of the change which starts at i
+func changeBlock(lines []DiffLine, i int) (dels, adds []int) {
+	for ; i < len(lines) && lines[i].Kind == "del"; i++ {
+		dels = append(dels, i)
+	}
+
+	for ; i < len(lines) && lines[i].Kind == "add"; i++ {
+		adds = append(adds, i)
+	}
+
+	return dels, adds
+}
+
+// statusName - human readable status of the change
+func statusName(status string) string {
+	switch status {
+	case "A":
+		return "added"
+	case "D":
+		return "deleted"
+	case "R":
+		return "renamed"
+	case "C":
+		return "copied"
+	case "T":
+		return "type changed"
+	}
+
+	return "modified"
+}
+
+// parseDiff - parse output of git diff
+func parseDiff(diff string) []FileDiff {
+	files := []FileDiff{}
+	var file *FileDiff
+	var hunk *DiffHunk
+	oldLeft, newLeft := 0, 0
+
+	for _, line := range strings.Split(diff, "\n") {
+		// lines of the hunk are counted, so content like "--- a" is not taken for a header
+		if hunk != nil && (oldLeft > 0 || newLeft > 0) {
+			switch {
+			case strings.HasPrefix(line, "+"):
+				hunk.Lines = append(hunk.Lines, DiffLine{Kind: "add", NewNumber: hunk.NewLine + 1, Text: line[1:]})
+				hunk.NewLine++
+				newLeft--
+				continue
+			case strings.HasPrefix(line, "-"):
+				hunk.Lines = append(hunk.Lines, DiffLine{Kind: "del", OldNumber: hunk.OldLine + 1, Text: line[1:]})
+				hunk.OldLine++
+				oldLeft--
+				continue
+			case strings.HasPrefix(line, " "), line == "":
+				text := ""
+				if line != "" {
+					text = line[1:]
+				}
+
+				hunk.Lines = append(hunk.Lines, DiffLine{Kind: "context", OldNumber: hunk.OldLine + 1, NewNumber: hunk.NewLine + 1, Text: text})
+				hunk.OldLine++
+				hunk.NewLine++
+				oldLeft--
+				newLeft--
+				continue
+			case strings.HasPrefix(line, `\`):
+				// \ No newline at end of file
+				continue
+			}
+		}
+
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			files = append(files, FileDiff{Status: "M"})
+			file = &files[len(files)-1]
+			file.OldPath, file.NewPath = splitDiffHeader(strings.TrimPrefix(line, "diff --git "))
+			hunk = nil
+		case file == nil:
+			continue
+		case strings.HasPrefix(line, "new file mode"):
+			file.Status = "A"
+		case strings.HasPrefix(line, "deleted file mode"):
+			file.Status = "D"
+		case strings.HasPrefix(line, "rename from "):
+			file.Status = "R"
+			file.OldPath = unquotePath(strings.TrimPrefix(line, "rename from "))
+		case strings.HasPrefix(line, "rename to "):
+			file.NewPath = unquotePath(strings.TrimPrefix(line, "rename to "))
+		case strings.HasPrefix(line, "index "):
+			file.OldBlob, file.NewBlob = parseIndexLine(line)
+		case strings.HasPrefix(line, "Binary files "), line == "GIT binary patch":
+			file.Binary = true
+		case strings.HasPrefix(line, "--- "):
+			if path := diffPath(strings.TrimPrefix(line, "--- "), "a/"); path != "" {
+				file.OldPath = path
+			}
+		case strings.HasPrefix(line, "+++ "):
+			if path := diffPath(strings.TrimPrefix(line, "+++ "), "b/"); path != "" {
+				file.NewPath = path
+			}
+		case strings.HasPrefix(line, "@@ "):
+			var h DiffHunk
+			h, oldLeft, newLeft = parseHunkHeader(line)
+			file.Hunks = append(file.Hunks, h)
+			hunk = &file.Hunks[len(file.Hunks)-1]
+		}
+	}
+
+	for i := range files {
+		if files[i].Status == "A" {
+			files[i].OldPath = ""
+		} else if files[i].Status == "D" {
+			files[i].NewPath = ""
+		}
+
+		for j := range files[i].Hunks {
+			highlightChanges(files[i].Hunks[j].Lines, nil)
+		}
+	}
+
+	return files
+}
+
+// parseIndexLine - object names of the "index 8f2b7c6..a6815d3 100644" line, empty for missing files
+func parseIndexLine(line string) (string, string) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return "", ""
+	}
+
+	blobs := strings.SplitN(fields[1], "..", 2)
+	if len(blobs) != 2 {
+		return "", ""
+	}
+
+	for i, blob := range blobs {
+		if strings.Trim(blob, "0") == "" {
+			blobs[i] = ""
+		}
+	}
+
+	return blobs[0], blobs[1]
+}
+
+// splitDiffHeader - paths of the "diff --git a/x b/x" line, used when there are no ---/+++ lines
+func splitDiffHeader(header string) (string, string) {
+	if strings.HasPrefix(header, `"`) {
+		if old, err := strconv.QuotedPrefix(header); err == nil {
+			return diffPath(old, "a/"), diffPath(strings.TrimSpace(header[len(old):]), "b/")
+		}
+	}
+
+	// both paths are the same unless the file is renamed, so the middle is the safe split point
+	if half := (len(header) - 1) / 2; len(header)%2 == 1 && header[half] == ' ' && header[2:half] == header[half+3:] {
+		return header[2:half], header[half+3:]
+	}
+
+	if i := strings.Index(header, " b/"); i >= 0 {
+		return diffPath(header[:i], "a/"), diffPath(header[i+1:], "b/")
+	}
+
+	return header, header
+}
+
+// diffPath - path of the ---/+++ line without a/ and b/ prefixes, empty for /dev/null
+func diffPath(path, prefix string) string {
+	path = unquotePath(strings.TrimSuffix(path, "\t"))
+	if path == "/dev/null" {
+		return ""
+	}
+
+	return strings.TrimPrefix(path, prefix)
+}
+
+// unquotePath - git quotes paths with special characters in the C style
+func unquotePath(path string) string {
+	if strings.HasPrefix(path, `"`) {
+		if unquoted, err := strconv.Unquote(path); err == nil {
+			return unquoted
+		}
+	}
+
+	return path
+}
+
+// parseHunkHeader - "@@ -1,5 +1,6 @@ heading" and the number of old and new lines in the hunk
+func parseHunkHeader(line string) (hunk DiffHunk, oldCount, newCount int) {
+	fields := strings.SplitN(line, "@@", 3)
+	if len(fields) < 3 {
+		return hunk, 0, 0
+	}
+
+	hunk.Header = line
+	for _, field := range strings.Fields(fields[1]) {
+		start, count := hunkRange(field[1:])
+		// OldLine and NewLine are the numbers of the lines before the hunk
+		if count > 0 {
+			start--
+		}
+
+		if strings.HasPrefix(field, "-") {
+			hunk.OldLine, oldCount = start, count
+		} else if strings.HasPrefix(field, "+") {
+			hunk.NewLine, newCount = start, count
+		}
+	}
+
+	return hunk, oldCount, newCount
+}
+
+// hunkRange - "start,count" where the count is 1 when omitted
+func hunkRange(value string) (int, int) {
+	parts := strings.SplitN(value, ",", 2)
+	start, _ := strconv.Atoi(parts[0])
+	count := 1
+	if len(parts) == 2 {
+		count, _ = strconv.Atoi(parts[1])
+	}
+
+	return start, count
+}
+
+// codeClasses - css classes of the code tokens, the page renderer gives the same ones to fenced code
+var codeClasses = syntaxhighlight.HTMLConfig{
+	String:        "s",
+	Keyword:       "k",
+	Comment:       "c",
+	Type:          "n",
+	Literal:       "o",
+	Punctuation:   "p",
+	Plaintext:     "n",
+	Tag:           "tag",
+	HTMLTag:       "htm",
+	HTMLAttrName:  "atn",
+	HTMLAttrValue: "atv",
+	Decimal:       "m",
+}
+
+// highlightChanges - fill html of the lines, code is highlighted for the lines the language is known for,
+// changed words of deleted lines and the added lines which replace them are marked
+func highlightChanges(lines []DiffLine, language func(DiffLine) string) {
+	marks := make([]annotate.Annotations, len(lines))
+	dmp := diffmatchpatch.New()
+	for i := 0; i < len(lines); {
+		if lines[i].Kind == "context" {
+			i++
+			continue
+		}
+
+		dels, adds := changeBlock(lines, i)
+		for j := 0; j < len(dels) && j < len(adds); j++ {
+			diffs := dmp.DiffMain(lines[dels[j]].Text, lines[adds[j]].Text, false)
+			diffs = dmp.DiffCleanupSemantic(diffs)
+			marks[dels[j]], marks[adds[j]] = changeMarks(diffs)
+		}
+
+		i += len(dels) + len(adds)
+	}
+
+	for i := range lines {
+		lang := ""
+		if language != nil {
+			lang = language(lines[i])
+		}
+
+		lines[i].HTML = lineHTML(lines[i].Text, lang, marks[i])
+	}
+}
+
+// changeMarks - changes of both sides of the diff wrapped into <del> and <ins>
+func changeMarks(diffs []diffmatchpatch.Diff) (old, new annotate.Annotations) {
+	oldAt, newAt := 0, 0
+	for _, diff := range diffs {
+		switch diff.Type {
+		case diffmatchpatch.DiffEqual:
+			oldAt += len(diff.Text)
+			newAt += len(diff.Text)
+		case diffmatchpatch.DiffDelete:
+			old = append(old, &annotate.Annotation{Start: oldAt, End: oldAt + len(diff.Text),
+				Left: []byte("<del>"), Right: []byte("</del>")})
+			oldAt += len(diff.Text)
+		case diffmatchpatch.DiffInsert:
+			new = append(new, &annotate.Annotation{Start: newAt, End: newAt + len(diff.Text),
+				Left: []byte("<ins>"), Right: []byte("</ins>")})
+			newAt += len(diff.Text)
+		}
+	}
+
+	return old, new
+}
+
+// lineHTML - escaped text of the line with the code tokens and the changes marked
+func lineHTML(text, language string, marks annotate.Annotations) template.HTML {
+	anns := append(codeTokens(text, language), marks...)
+	if len(anns) == 0 {
+		return template.HTML(template.HTMLEscapeString(text))
+	}
+
+	sort.Sort(anns)
+	out, err := annotate.Annotate([]byte(text), anns, template.HTMLEscape)
+	if err != nil {
+		return template.HTML(template.HTMLEscapeString(text))
+	}
+
+	return template.HTML(out)
+}
+
+// codeTokens - spans of the code tokens of the line, go is highlighted like the page renderer does it,
+// other languages by the generic highlighter
+func codeTokens(text, language string) annotate.Annotations {
+	var anns annotate.Annotations
+	var err error
+	switch strings.ToLower(language) {
+	case "":
+		return nil
+	case "go", "go-unformatted":
+		anns, err = highlight_go.Annotate([]byte(text), syntaxhighlight.HTMLAnnotator(codeClasses))
+	default:
+		anns, err = syntaxhighlight.Annotate([]byte(text), syntaxhighlight.HTMLAnnotator(codeClasses))
+	}
+
+	if err != nil {
+		return nil
+	}
+
+	return anns
+}
+
+// codeLanguages - language of every line of the markdown text, it's empty for the lines out of fenced code
+// blocks, fences themselves and blocks without the language
+func codeLanguages(text string) []string {
+	lines := splitLines(text)
+	languages := make([]string, len(lines))
+	fence, language := "", ""
+	for i, line := range lines {
+		trimmed := strings.TrimLeft(line, " ")
+		if len(line)-len(trimmed) > 3 {
+			languages[i] = language
+			continue
+		}
+
+		marker := strings.TrimLeft(trimmed, "`~")
+		marker = trimmed[:len(trimmed)-len(marker)]
+		switch {
+		case fence == "" && len(marker) >= 3 && strings.Trim(marker, marker[:1]) == "":
+			fence, language = marker, ""
+			if fields := strings.Fields(trimmed[len(marker):]); len(fields) > 0 {
+				language = strings.TrimPrefix(fields[0], ".")
+			}
+		case fence != "" && strings.HasPrefix(marker, fence) && strings.Trim(marker, fence[:1]) == "" &&
+			strings.TrimSpace(trimmed[len(marker):]) == "":
+			fence, language = "", ""
+		default:
+			languages[i] = language
+		}
+	}
+
+	return languages
+}
+
+// tokenRunes - tokens like words or lines mapped to runes, so diffmatchpatch can diff sequences of them
+type tokenRunes struct {
+	runes  map[string]rune
+	values []string
+}
+
+// newTokenRunes - empty mapping
+func newTokenRunes() *tokenRunes {
+	return &tokenRunes{runes: make(map[string]rune)}
+}
+
+// encode - runes of the tokens, new tokens get the next free rune
+func (t *tokenRunes) encode(tokens []string) []rune {
+	runes := make([]rune, 0, len(tokens))
+	for _, token := range tokens {
+		r, ok := t.runes[token]
+		if !ok {
+			r = rune(len(t.values) + 1)
+			// runes from the surrogate range can't survive the conversion to a string
+			if r >= 0xD800 {
+				r += 0x800
+			}
+
+			t.runes[token] = r
+			t.values = append(t.values, token)
+		}
+
+		runes = append(runes, r)
+	}
+
+	return runes
+}
+
+// decode - token of the rune
+func (t *tokenRunes) decode(r rune) string {
+	if r >= 0xE000 {
+		r -= 0x800
+	}
+
+	return t.values[r-1]
+}
+
+// splitLines - lines of the text without line breaks, the last line break doesn't start a new line
+func splitLines(text string) []string {
+	if text == "" {
+		return []string{}
+	}
+
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
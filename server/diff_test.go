@@ -0,0 +1,145 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDiff(t *testing.T) {
+	diff := "diff --git a/my notes.md b/my notes.md\n" +
+		"index 8f2b7c6..a6815d3 100644\n" +
+		"--- a/my notes.md\n" +
+		"+++ b/my notes.md\n" +
+		"@@ -1,4 +1,3 @@ # Notes\n" +
+		" # Notes\n" +
+		"-old <b>rule</b>\n" +
+		"--- a\n" +
+		"+new <b>rule</b>\n" +
+		" end\n" +
+		"\\ No newline at end of file\n" +
+		"diff --git a/logo.png b/logo.png\n" +
+		"new file mode 100644\n" +
+		"index 0000000..8f2b7c6\n" +
+		"Binary files /dev/null and b/logo.png differ\n" +
+		"diff --git a/old.md b/new.md\n" +
+		"similarity index 100%\n" +
+		"rename from old.md\n" +
+		"rename to new.md\n"
+
+	files := parseDiff(diff)
+	if len(files) != 3 {
+		t.Fatalf("expected 3 files, got %+v", files)
+	}
+
+	notes := files[0]
+	if notes.Path() != "my notes.md" || notes.Status != "M" || len(notes.Hunks) != 1 {
+		t.Fatalf("unexpected file: %+v", notes)
+	}
+
+	lines := notes.Hunks[0].Lines
+	if len(lines) != 5 {
+		t.Fatalf("expected 5 lines, got %+v", lines)
+	}
+
+	if lines[1].Kind != "del" || lines[1].OldNumber != 2 || lines[1].HTML != "<del>old</del> &lt;b&gt;rule&lt;/b&gt;" {
+		t.Errorf("unexpected deleted line: %+v", lines[1])
+	}
+
+	if lines[2].Kind != "del" || lines[2].OldNumber != 3 || lines[2].Text != "-- a" {
+		t.Errorf("unexpected deleted line: %+v", lines[2])
+	}
+
+	if lines[3].Kind != "add" || lines[3].NewNumber != 2 || lines[3].HTML != "<ins>new</ins> &lt;b&gt;rule&lt;/b&gt;" {
+		t.Errorf("unexpected added line: %+v", lines[3])
+	}
+
+	if lines[4].Kind != "context" || lines[4].OldNumber != 4 || lines[4].NewNumber != 3 {
+		t.Errorf("unexpected context line: %+v", lines[4])
+	}
+
+	rows := notes.Hunks[0].Rows()
+	if len(rows) != 4 || rows[1].Old != &lines[1] || rows[1].New != &lines[3] || rows[2].New != nil {
+		t.Errorf("unexpected rows: %+v", rows)
+	}
+
+	logo := files[1]
+	if !logo.Binary || !logo.IsImage() || logo.Status != "A" || logo.Path() != "logo.png" || logo.OldPath != "" {
+		t.Errorf("unexpected binary file: %+v", logo)
+	}
+
+	if logo.OldBlob != "" || logo.NewBlob != "8f2b7c6" || logo.NewURL() != "/_blob/8f2b7c6/logo.png" {
+		t.Errorf("unexpected objects of the binary file: %+v", logo)
+	}
+
+	if renamed := files[2]; renamed.Status != "R" || renamed.OldPath != "old.md" || renamed.NewPath != "new.md" {
+		t.Errorf("unexpected renamed file: %+v", renamed)
+	}
+}
+
+func TestCodeLanguages(t *testing.T) {
+	text := "# Code\n\n```go\nfunc main() {\n    ```\n}\n```\n\n~~~~ .sh extra\nls\n~~~\n~~~~\n```\nplain\n"
+	expected := []string{"", "", "", "go", "go", "go", "", "", "", "sh", "sh", "", "", ""}
+	if languages := codeLanguages(text); !reflect.DeepEqual(languages, expected) {
+		t.Errorf("expected %q, got %q", expected, languages)
+	}
+}
+
+func TestHighlightCode(t *testing.T) {
+	if _, err := exec.LookPath(gitBinary); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	code := "# Code\n\n```go\nfunc main() {\n\tfirst()\n\tsecond()\n\tthird()\n\tfourth()\n\treturn\n}\n```\n"
+	dir := writeDocroot(t, map[string]string{"code.md": code})
+	git := func(args ...string) {
+		cmd := exec.Command(gitBinary, append([]string{"-c", "user.name=Ann", "-c", "user.email=ann@example.com"}, args...)...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_NOSYSTEM=1", "HOME="+dir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	git("init", "-q")
+	git("add", "-A")
+	git("commit", "-q", "-m", "Add code")
+	if err := ioutil.WriteFile(filepath.Join(dir, "code.md"), []byte(strings.Replace(code, "return", "return nil", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	git("commit", "-q", "-a", "-m", "Return nil")
+
+	r := NewRenderer(dir, make(chan interface{}, 1))
+	r.scanStorage()
+
+	// the hunk starts below the fence, the language comes from the whole file
+	diffs, err := r.GetFileDiffs("HEAD~1", "HEAD", "code.md")
+	if err != nil || len(diffs) != 1 || len(diffs[0].Hunks) != 1 {
+		t.Fatalf("unexpected diffs: %+v, %v", diffs, err)
+	}
+
+	html := map[string]string{}
+	for _, line := range diffs[0].Hunks[0].Lines {
+		html[line.Kind+" "+line.Text] = string(line.HTML)
+	}
+
+	expected := map[string]string{
+		"context \tthird()":  "\t<span class=\"n\">third</span><span class=\"n\">(</span><span class=\"n\">)</span>",
+		"del \treturn":       "\t<span class=\"k\">return</span>",
+		"add \treturn nil":   "\t<span class=\"k\">return</span><ins> <span class=\"o\">nil</span></ins>",
+		"context }":          "<span class=\"n\">}</span>",
+		"context ```":        "```",
+		"context \tfourth()": "\t<span class=\"n\">fourth</span><span class=\"n\">(</span><span class=\"n\">)</span>",
+		"context \tsecond()": "\t<span class=\"n\">second</span><span class=\"n\">(</span><span class=\"n\">)</span>",
+	}
+	for line, expectedHTML := range expected {
+		if html[line] != expectedHTML {
+			t.Errorf("%q: expected %q, got %q", line, expectedHTML, html[line])
+		}
+	}
+}
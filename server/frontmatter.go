@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// PageMeta - metadata declared in the YAML front matter of the page
+type PageMeta struct {
+	Title       string                 `yaml:"title"`
+	Description string                 `yaml:"description"`
+	Tags        stringList             `yaml:"tags"`
+	Aliases     stringList             `yaml:"aliases"`
+	Author      string                 `yaml:"author"`
+	Extra       map[string]interface{} `yaml:",inline"` // all custom keys
+}
+
+// stringList - list of strings which may be written as a single comma separated value too
+type stringList []string
+
+// UnmarshalYAML - accept both "tags: [a, b]" and "tags: a, b"
+func (l *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*l = list
+		return nil
+	}
+
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+
+	return nil
+}
+
+// splitFrontMatter - separate the YAML front matter from the markdown body.
+// The front matter has to start at the first line with "---" and end with "---" or "...".
+// Body is returned as is in case of no front matter or if it isn't a valid YAML mapping.
+func splitFrontMatter(bts []byte) (meta PageMeta, body []byte, err error) {
+	body = bytes.TrimPrefix(bts, []byte("\xef\xbb\xbf"))
+	lines := bytes.SplitAfter(body, []byte("\n"))
+	if len(lines) == 0 || string(bytes.TrimSpace(lines[0])) != "---" {
+		return meta, bts, nil
+	}
+
+	offset := len(lines[0])
+	for _, line := range lines[1:] {
+		switch string(bytes.TrimSpace(line)) {
+		case "---", "...":
+			if err = yaml.Unmarshal(body[len(lines[0]):offset], &meta); err != nil {
+				return PageMeta{}, bts, err
+			}
+
+			return meta, body[offset+len(line):], nil
+		}
+
+		offset += len(line)
+	}
+
+	// opening delimiter without closing one is just a horizontal rule
+	return meta, bts, nil
+}
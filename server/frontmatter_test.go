@@ -0,0 +1,36 @@
+package server
+
+import "testing"
+
+func TestSplitFrontMatter(t *testing.T) {
+	src := "---\ntitle: DB failover\ntags: db, oncall\naliases: [failover]\nowner: sre\n---\n# Heading\n"
+	meta, body, err := splitFrontMatter([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.Title != "DB failover" || len(meta.Tags) != 2 || meta.Tags[1] != "oncall" || meta.Aliases[0] != "failover" {
+		t.Errorf("unexpected meta: %+v", meta)
+	}
+
+	if meta.Extra["owner"] != "sre" {
+		t.Errorf("custom key is lost: %+v", meta.Extra)
+	}
+
+	if string(body) != "# Heading\n" {
+		t.Errorf("unexpected body: %q", body)
+	}
+}
+
+func TestSplitFrontMatterWithoutHeader(t *testing.T) {
+	for _, src := range []string{
+		"# Heading\n---\ntext\n",
+		"---\nnot closed\n",
+		"---\nSetext heading\n---\n",
+	} {
+		meta, body, _ := splitFrontMatter([]byte(src))
+		if string(body) != src || meta.Title != "" {
+			t.Errorf("%q: body has to be left as is, got %q", src, body)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+)
+
+// maxHookPayload - largest payload GitHub sends
+const maxHookPayload = 25 << 20
+
+// pushEvent - part of the push payload which is the same for GitHub, GitLab and Gitea
+type pushEvent struct {
+	Ref   string `json:"ref"`
+	After string `json:"after"`
+}
+
+// verifyHook - check the payload is signed with the secret, the headers tell which service sent it
+func verifyHook(header http.Header, body []byte, secret string) error {
+	if secret == "" {
+		return fmt.Errorf("The secret is not configured")
+	}
+
+	// GitHub and recent Gitea
+	if signature := header.Get("X-Hub-Signature-256"); signature != "" {
+		return verifySignature(sha256.New, secret, body, strings.TrimPrefix(signature, "sha256="))
+	}
+
+	// Gitea and Gogs
+	if signature := header.Get("X-Gitea-Signature"); signature != "" {
+		return verifySignature(sha256.New, secret, body, signature)
+	}
+
+	// GitLab sends the secret itself
+	if token := header.Get("X-Gitlab-Token"); token != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return fmt.Errorf("Invalid token")
+		}
+
+		return nil
+	}
+
+	// old GitHub setups sign with sha1 only
+	if signature := header.Get("X-Hub-Signature"); signature != "" {
+		return verifySignature(sha1.New, secret, body, strings.TrimPrefix(signature, "sha1="))
+	}
+
+	return fmt.Errorf("The payload is not signed")
+}
+
+// verifySignature - compare hex encoded hmac of the body with the expected one
+func verifySignature(hashFunc func() hash.Hash, secret string, body []byte, signature string) error {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("Invalid signature")
+	}
+
+	mac := hmac.New(hashFunc, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return fmt.Errorf("Invalid signature")
+	}
+
+	return nil
+}
+
+// hookEvent - name of the event, push events are "push" or "Push Hook" for GitLab
+func hookEvent(header http.Header) string {
+	for _, name := range []string{"X-GitHub-Event", "X-Gitea-Event", "X-Gogs-Event", "X-Gitlab-Event"} {
+		if event := header.Get(name); event != "" {
+			return event
+		}
+	}
+
+	return ""
+}
+
+// pushHook - webhook of GitHub, GitLab and Gitea, a push to the tracked branch fetches the mirror and
+// reloads the wiki right away
+func (s *Server) pushHook(c *gin.Context) {
+	if s.mirror == nil || s.hookSecret == "" {
+		c.AbortWithError(http.StatusNotFound, fmt.Errorf("Webhooks are not configured"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxHookPayload))
+	if err != nil {
+		c.AbortWithError(http.StatusRequestEntityTooLarge, err)
+		return
+	}
+
+	if err := verifyHook(c.Request.Header, body, s.hookSecret); err != nil {
+		log.Warnf("Rejected webhook from %s: %v", c.ClientIP(), err)
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+
+	switch hookEvent(c.Request.Header) {
+	case "ping":
+		c.JSON(http.StatusOK, gin.H{"status": "pong"})
+		return
+	case "push", "Push Hook":
+	default:
+		c.JSON(http.StatusOK, gin.H{"status": "ignored", "reason": "not a push event"})
+		return
+	}
+
+	event := pushEvent{}
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&event); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	tracked, err := s.mirror.TrackedRef()
+	if err != nil {
+		c.AbortWithError(http.StatusServiceUnavailable, err)
+		return
+	}
+
+	if event.Ref != tracked {
+		c.JSON(http.StatusOK, gin.H{"status": "ignored", "reason": "not the tracked branch " + tracked})
+		return
+	}
+
+	// senders give up waiting in a few seconds, the fetch may take longer
+	go func() {
+		if err := s.mirror.Sync(); err == nil {
+			s.renderer.Rescan()
+		}
+	}()
+
+	c.JSON(http.StatusAccepted, gin.H{"status": "syncing", "ref": event.Ref, "after": event.After})
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func TestVerifyHook(t *testing.T) {
+	body := []byte(`{"ref":"refs/heads/master"}`)
+	sign := func(hashName string) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		if hashName == "sha1" {
+			mac = hmac.New(sha1.New, []byte("secret"))
+		}
+		mac.Write(body)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	tests := []struct {
+		header http.Header
+		valid  bool
+	}{
+		{http.Header{"X-Hub-Signature-256": {"sha256=" + sign("sha256")}}, true},
+		{http.Header{"X-Hub-Signature-256": {"sha256=" + sign("sha1")}}, false},
+		{http.Header{"X-Hub-Signature": {"sha1=" + sign("sha1")}}, true},
+		{http.Header{"X-Gitea-Signature": {sign("sha256")}}, true},
+		{http.Header{"X-Gitea-Signature": {"not hex"}}, false},
+		{http.Header{"X-Gitlab-Token": {"secret"}}, true},
+		{http.Header{"X-Gitlab-Token": {"guess"}}, false},
+		{http.Header{}, false},
+	}
+
+	for _, test := range tests {
+		if err := verifyHook(test.header, body, "secret"); (err == nil) != test.valid {
+			t.Errorf("verifyHook(%v) = %v, want valid %v", test.header, err, test.valid)
+		}
+	}
+
+	if err := verifyHook(http.Header{"X-Gitlab-Token": {""}}, body, ""); err == nil {
+		t.Errorf("verifyHook accepted a payload without a configured secret")
+	}
+}
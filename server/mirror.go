@@ -0,0 +1,335 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// maxMirrorBackoff - longest delay between attempts to sync a failing mirror
+const maxMirrorBackoff = time.Hour
+
+// defaultMirrorInterval - delay between fetches unless it's configured
+const defaultMirrorInterval = 10 * time.Minute
+
+// mirrorTimeout - clones and fetches running longer are killed and the sync fails
+const mirrorTimeout = 10 * time.Minute
+
+// MirrorStatus - state of the mirror reported in the footer and at /_mirror.json
+type MirrorStatus struct {
+	URL         string    `json:"url"`
+	Head        string    `json:"head"`
+	LastSync    time.Time `json:"last_sync"`
+	LastAttempt time.Time `json:"last_attempt"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	Failures    int       `json:"failures"`
+	Stale       bool      `json:"stale"`
+}
+
+// Mirror - keeps the docroot in sync with the remote repository
+type Mirror struct {
+	url      string
+	path     string
+	bare     bool
+	branch   string
+	interval time.Duration
+	timeout  time.Duration // clones and fetches running longer are killed
+	token    string        // token of https remotes
+	sshKey   string        // private key of ssh remotes
+	status   MirrorStatus
+	mx       sync.RWMutex
+	syncMx   sync.Mutex // git can't fetch into the same repository concurrently
+}
+
+// NewMirror - create a mirror of the remote repository in the path, which is a bare repository in bare mode
+func NewMirror(remote, path string, bare bool, branch string, interval time.Duration, token, sshKey string) *Mirror {
+	if interval <= 0 {
+		interval = defaultMirrorInterval
+	}
+
+	m := &Mirror{
+		url:      remote,
+		path:     path,
+		bare:     bare,
+		branch:   branch,
+		interval: interval,
+		timeout:  mirrorTimeout,
+		token:    token,
+		sshKey:   sshKey,
+	}
+
+	// nothing is served until the first clone succeeds
+	m.status = MirrorStatus{URL: displayURL(remote), Stale: !m.isCloned()}
+	return m
+}
+
+// Init - clone the repository or fetch it if it's cloned already, retried until it succeeds, the status
+// reports the failures meanwhile
+func (m *Mirror) Init() {
+	for m.Sync() != nil {
+		m.mx.RLock()
+		delay := time.Until(m.status.NextAttempt)
+		m.mx.RUnlock()
+
+		time.Sleep(delay)
+	}
+}
+
+// Run - cycle of syncing the mirror, the delay grows exponentially while syncing fails
+func (m *Mirror) Run() {
+	for {
+		m.mx.RLock()
+		delay := time.Until(m.status.NextAttempt)
+		m.mx.RUnlock()
+
+		time.Sleep(delay)
+		m.Sync()
+	}
+}
+
+// Sync - clone or fetch the repository once
+func (m *Mirror) Sync() error {
+	m.syncMx.Lock()
+	defer m.syncMx.Unlock()
+
+	started := time.Now()
+	err := m.fetch()
+
+	var head string
+	if err == nil {
+		head, err = m.head()
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.status.LastAttempt = started
+	if err != nil {
+		m.status.Failures++
+		m.status.LastError = err.Error()
+		m.status.NextAttempt = time.Now().Add(m.backoff(m.status.Failures))
+		m.status.Stale = true
+		log.Errorf("Can't sync the mirror of %s: %v", m.status.URL, err)
+		return err
+	}
+
+	m.status.Failures = 0
+	m.status.LastError = ""
+	m.status.LastSync = started
+	m.status.NextAttempt = time.Now().Add(m.interval)
+	m.status.Stale = false
+	m.status.Head = head
+
+	return nil
+}
+
+// Status - state of the mirror
+func (m *Mirror) Status() MirrorStatus {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
+	return m.status
+}
+
+// backoff - delay after the number of failures in a row
+func (m *Mirror) backoff(failures int) time.Duration {
+	limit := maxMirrorBackoff
+	if m.interval > limit {
+		limit = m.interval
+	}
+
+	delay := m.interval
+	for i := 1; i < failures && delay < limit; i++ {
+		delay *= 2
+	}
+
+	if delay > limit {
+		delay = limit
+	}
+
+	return delay
+}
+
+// fetch - clone the repository on the first run, fetch it later
+func (m *Mirror) fetch() error {
+	if !m.isCloned() {
+		args := []string{"clone"}
+		if m.bare {
+			// all branches and tags are kept, so any of them can be browsed
+			args = append(args, "--mirror")
+		} else if m.branch != "" {
+			args = append(args, "--branch", m.branch)
+		}
+
+		// a killed clone leaves a broken repository behind, it's removed so the next attempt starts over
+		empty := isEmptyDir(m.path)
+		err := m.git(append(args, "--", m.url, m.path)...)
+		if err != nil && empty {
+			removeContents(m.path)
+		}
+
+		return err
+	}
+
+	if m.bare {
+		return m.git("--git-dir", m.path, "remote", "update", "--prune")
+	}
+
+	// the working tree follows the remote even after force pushes
+	if err := m.git("-C", m.path, "fetch", "--prune", "origin"); err != nil {
+		return err
+	}
+
+	return m.git("-C", m.path, "reset", "--hard", "@{upstream}")
+}
+
+// head - commit of the served branch
+func (m *Mirror) head() (string, error) {
+	revision := "HEAD"
+	if m.bare && m.branch != "" {
+		revision = m.branch
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+
+	out, err := m.command(ctx, "--git-dir", m.gitDir(), "rev-parse", "--verify", revision+"^{commit}").Output()
+	if err != nil {
+		return "", fmt.Errorf("Can't resolve %s: %v", revision, err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// TrackedRef - full name of the served branch: refs/heads/master
+func (m *Mirror) TrackedRef() (string, error) {
+	if m.branch != "" {
+		return "refs/heads/" + m.branch, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+
+	out, err := m.command(ctx, "--git-dir", m.gitDir(), "symbolic-ref", "HEAD").Output()
+	if err != nil {
+		return "", fmt.Errorf("Can't find the branch of HEAD: %v", err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// isCloned - the repository is in the path already
+func (m *Mirror) isCloned() bool {
+	_, err := os.Stat(filepath.Join(m.gitDir(), "HEAD"))
+	return err == nil
+}
+
+// isEmptyDir - the folder has no files or doesn't exist
+func isEmptyDir(path string) bool {
+	files, err := ioutil.ReadDir(path)
+	return err == nil && len(files) == 0 || os.IsNotExist(err)
+}
+
+// removeContents - remove everything in the folder but the folder itself, it's watched for changes
+func removeContents(path string) {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		if err := os.RemoveAll(filepath.Join(path, file.Name())); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// gitDir - git directory of the mirror
+func (m *Mirror) gitDir() string {
+	if m.bare {
+		return m.path
+	}
+
+	return filepath.Join(m.path, ".git")
+}
+
+// git - run git with the credentials, the first fatal or error line of the output is reported in the error,
+// progress like "Cloning into..." and advice come around it. Git is killed after the timeout of the mirror,
+// so a stalled network doesn't block the next syncs.
+func (m *Mirror) git(args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	out, err := m.command(ctx, args...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+
+	// -C and --git-dir go before the command
+	command := args[0]
+	if (command == "-C" || command == "--git-dir") && len(args) > 2 {
+		command = args[2]
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("git %s took longer than %v", command, m.timeout)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	message := lines[0]
+	for _, line := range lines {
+		if strings.HasPrefix(line, "fatal:") || strings.HasPrefix(line, "error:") {
+			message = line
+			break
+		}
+	}
+
+	return fmt.Errorf("git %s: %v: %s", command, err, message)
+}
+
+// command - git command with the credentials passed through the environment, so they are not seen in the
+// list of processes. Transfers slower than 1KB/s for a minute are aborted by git itself, so its helpers don't
+// outlive the killed command.
+func (m *Mirror) command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, gitBinary, args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_HTTP_LOW_SPEED_LIMIT=1000",
+		"GIT_HTTP_LOW_SPEED_TIME=60")
+	if m.token != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + m.token))
+		cmd.Env = append(cmd.Env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+		)
+	}
+
+	if m.sshKey != "" {
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND=ssh -i '"+strings.Replace(m.sshKey, "'", `'\''`, -1)+
+			"' -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new -o ConnectTimeout=30"+
+			" -o ServerAliveInterval=15")
+	}
+
+	return cmd
+}
+
+// displayURL - url of the remote without credentials
+func displayURL(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil || u.User == nil {
+		return remote
+	}
+
+	u.User = nil
+	return u.String()
+}
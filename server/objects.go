@@ -0,0 +1,815 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Types of git objects as they are stored in packfiles
+const (
+	objectCommit   = 1
+	objectTree     = 2
+	objectBlob     = 3
+	objectTag      = 4
+	objectOfsDelta = 6
+	objectRefDelta = 7
+)
+
+// objectTypes - names of the object types used in loose objects and tags
+var objectTypes = map[string]int{
+	"commit": objectCommit,
+	"tree":   objectTree,
+	"blob":   objectBlob,
+	"tag":    objectTag,
+}
+
+// maxCachedObjects - commits and trees kept in memory, walking the history reads them over and over
+const maxCachedObjects = 20000
+
+// maxDeltaBases - delta bases of a packfile kept in memory
+const maxDeltaBases = 256
+
+// maxDeltaBaseSize - bigger objects are not kept as delta bases
+const maxDeltaBaseSize = 1 << 20
+
+// maxDeltaDepth - longest chain of deltas, git doesn't write longer ones, so a longer chain is a loop of
+// a corrupt pack
+const maxDeltaDepth = 4096
+
+// maxObjectSize - biggest object read into memory, a corrupt size must not allocate more
+const maxObjectSize = 1 << 30
+
+// maxDeflateRatio - deflate doesn't expand the data more than that, a bigger size can't be read from the rest
+// of the pack
+const maxDeflateRatio = 1032
+
+// errObjectNotFound - the object is neither loose nor packed
+var errObjectNotFound = errors.New("object not found")
+
+// gitObject - type and content of the object
+type gitObject struct {
+	kind int
+	data []byte
+}
+
+// objectStore - loose objects and packfiles of the repository read without git
+type objectStore struct {
+	dirs  []string // objects directory and its alternates
+	mx    sync.Mutex
+	packs []*packFile
+	cache map[string]*gitObject // commits and trees, blobs are big and read once
+}
+
+// newObjectStore - objects of the directory and the alternates listed in info/alternates
+func newObjectStore(dir string) (*objectStore, error) {
+	s := &objectStore{dirs: []string{dir}, cache: make(map[string]*gitObject)}
+	if bts, err := ioutil.ReadFile(filepath.Join(dir, "info", "alternates")); err == nil {
+		for _, line := range strings.Split(string(bts), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			if !filepath.IsAbs(line) {
+				line = filepath.Join(dir, line)
+			}
+
+			s.dirs = append(s.dirs, line)
+		}
+	}
+
+	if err := s.loadPacks(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// loadPacks - open packfiles which appeared since the last call, packs removed by gc are dropped and closed
+func (s *objectStore) loadPacks() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	opened := make(map[string]*packFile)
+	for _, pack := range s.packs {
+		opened[pack.path] = pack
+	}
+
+	packs := []*packFile{}
+	for _, dir := range s.dirs {
+		indexes, err := filepath.Glob(filepath.Join(dir, "pack", "*.idx"))
+		if err != nil {
+			return err
+		}
+
+		for _, index := range indexes {
+			path := strings.TrimSuffix(index, ".idx") + ".pack"
+			if pack, ok := opened[path]; ok {
+				packs = append(packs, pack)
+				continue
+			}
+
+			pack, err := openPackFile(index, path)
+			if os.IsNotExist(err) {
+				// removed by gc right now
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			packs = append(packs, pack)
+		}
+	}
+
+	for _, pack := range packs {
+		delete(opened, pack.path)
+	}
+
+	for _, pack := range opened {
+		pack.close()
+	}
+
+	s.packs = packs
+	return nil
+}
+
+// read - object by the full name
+func (s *objectStore) read(name string) (*gitObject, error) {
+	return s.readDepth(name, 0)
+}
+
+// readDepth - object by the full name, which is the base of the delta chain of the depth
+func (s *objectStore) readDepth(name string, depth int) (*gitObject, error) {
+	s.mx.Lock()
+	obj, ok := s.cache[name]
+	s.mx.Unlock()
+	if ok {
+		return obj, nil
+	}
+
+	id, err := hex.DecodeString(name)
+	if err != nil || len(id) != 20 {
+		return nil, fmt.Errorf("Invalid object name %q", name)
+	}
+
+	obj, err = s.find(name, id, depth)
+	if err == errObjectNotFound {
+		// fetch and gc add packs and remove loose objects
+		if err = s.loadPacks(); err == nil {
+			obj, err = s.find(name, id, depth)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if obj.kind == objectCommit || obj.kind == objectTree {
+		s.mx.Lock()
+		if len(s.cache) >= maxCachedObjects {
+			s.cache = make(map[string]*gitObject)
+		}
+
+		s.cache[name] = obj
+		s.mx.Unlock()
+	}
+
+	return obj, nil
+}
+
+// readType - object of the expected type
+func (s *objectStore) readType(name string, kind int) ([]byte, error) {
+	obj, err := s.read(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if obj.kind != kind {
+		return nil, fmt.Errorf("%s is not a %s", name, objectTypeName(kind))
+	}
+
+	return obj.data, nil
+}
+
+// find - look for the object among loose objects and in packfiles
+func (s *objectStore) find(name string, id []byte, depth int) (*gitObject, error) {
+	s.mx.Lock()
+	packs := s.packs
+	s.mx.Unlock()
+
+	for _, pack := range packs {
+		if offset, ok := pack.find(id); ok {
+			obj, err := pack.read(offset, s, depth)
+			if err != nil && pack.isClosed() {
+				// removed by gc meanwhile, the object is in another pack now
+				return nil, errObjectNotFound
+			}
+
+			return obj, err
+		}
+	}
+
+	for _, dir := range s.dirs {
+		obj, err := readLooseObject(filepath.Join(dir, name[:2], name[2:]))
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		return obj, err
+	}
+
+	return nil, errObjectNotFound
+}
+
+// has - the object exists
+func (s *objectStore) has(name string) bool {
+	_, err := s.read(name)
+	return err == nil
+}
+
+// expand - full names of objects which start with the hexadecimal prefix
+func (s *objectStore) expand(prefix string) []string {
+	found := make(map[string]bool)
+	for _, dir := range s.dirs {
+		entries, err := ioutil.ReadDir(filepath.Join(dir, prefix[:2]))
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			if name := prefix[:2] + entry.Name(); len(name) == 40 && strings.HasPrefix(name, prefix) {
+				found[name] = true
+			}
+		}
+	}
+
+	s.mx.Lock()
+	packs := s.packs
+	s.mx.Unlock()
+
+	first, _ := strconv.ParseUint(prefix[:2], 16, 8)
+	for _, pack := range packs {
+		for i := pack.first(byte(first)); i < pack.count && pack.name(i)[0] == byte(first); i++ {
+			if name := hex.EncodeToString(pack.name(i)); strings.HasPrefix(name, prefix) {
+				found[name] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// readLooseObject - zlib compressed "<type> <size>\0<content>"
+func readLooseObject(path string) (*gitObject, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	zr, err := zlib.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("Can't read %s: %v", path, err)
+	}
+
+	defer zr.Close()
+
+	// the header goes before the content, a byte over the limit tells the object is too big
+	limit := int64(maxObjectSize + 64)
+	data, err := ioutil.ReadAll(io.LimitReader(zr, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("Can't read %s: %v", path, err)
+	}
+
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("Object %s is too big", path)
+	}
+
+	nul := bytes.IndexByte(data, 0)
+	if nul < 0 {
+		return nil, fmt.Errorf("Invalid object %s", path)
+	}
+
+	header := strings.Fields(string(data[:nul]))
+	if len(header) != 2 || objectTypes[header[0]] == 0 {
+		return nil, fmt.Errorf("Invalid object %s", path)
+	}
+
+	return &gitObject{kind: objectTypes[header[0]], data: data[nul+1:]}, nil
+}
+
+// objectTypeName - name of the object type
+func objectTypeName(kind int) string {
+	for name, k := range objectTypes {
+		if k == kind {
+			return name
+		}
+	}
+
+	return "object"
+}
+
+// packFile - packfile with its version 2 index
+type packFile struct {
+	path    string
+	file    *os.File
+	fanout  [256]uint32
+	names   []byte // sorted 20 bytes object names
+	offsets []byte // 4 bytes offsets, large ones point into the 8 bytes table
+	large   []byte
+	count   int
+	size    int64
+	mx      sync.Mutex
+	bases   map[int64]*gitObject // recently read objects, they are likely bases of the next deltas
+	closed  bool                 // the pack was removed from the disk
+}
+
+// openPackFile - read the index and keep the pack open
+func openPackFile(index, path string) (*packFile, error) {
+	idx, err := ioutil.ReadFile(index)
+	if err != nil {
+		return nil, err
+	}
+
+	// \377tOc, version 2, fanout table, names, crc32s, offsets, large offsets, checksums
+	if len(idx) < 8+256*4 || !bytes.Equal(idx[:4], []byte{0xff, 't', 'O', 'c'}) || binary.BigEndian.Uint32(idx[4:8]) != 2 {
+		return nil, fmt.Errorf("Unsupported pack index %s", index)
+	}
+
+	p := &packFile{path: path, bases: make(map[int64]*gitObject)}
+	for i := range p.fanout {
+		p.fanout[i] = binary.BigEndian.Uint32(idx[8+i*4:])
+	}
+
+	p.count = int(p.fanout[255])
+	namesAt := 8 + 256*4
+	offsetsAt := namesAt + p.count*20 + p.count*4
+	largeAt := offsetsAt + p.count*4
+	if len(idx) < largeAt+40 {
+		return nil, fmt.Errorf("Truncated pack index %s", index)
+	}
+
+	p.names = idx[namesAt : namesAt+p.count*20]
+	p.offsets = idx[offsetsAt:largeAt]
+	p.large = idx[largeAt : len(idx)-40]
+
+	if p.file, err = os.Open(path); err != nil {
+		return nil, err
+	}
+
+	info, err := p.file.Stat()
+	if err != nil {
+		p.file.Close()
+		return nil, err
+	}
+
+	p.size = info.Size()
+
+	return p, nil
+}
+
+// close - close the file of the pack removed from the disk, reads which are running fail
+func (p *packFile) close() {
+	p.mx.Lock()
+	if p.closed {
+		p.mx.Unlock()
+		return
+	}
+
+	p.closed = true
+	p.bases = make(map[int64]*gitObject)
+	p.mx.Unlock()
+
+	if err := p.file.Close(); err != nil {
+		log.Error(err)
+	}
+}
+
+// isClosed - the pack was removed from the disk
+func (p *packFile) isClosed() bool {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	return p.closed
+}
+
+// name - object name at the position of the index
+func (p *packFile) name(i int) []byte {
+	return p.names[i*20 : i*20+20]
+}
+
+// first - position of the first object which starts with the byte
+func (p *packFile) first(b byte) int {
+	if b == 0 {
+		return 0
+	}
+
+	return int(p.fanout[b-1])
+}
+
+// find - offset of the object in the pack
+func (p *packFile) find(id []byte) (int64, bool) {
+	lo, hi := p.first(id[0]), int(p.fanout[id[0]])
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(p.name(lo+i), id) >= 0
+	})
+
+	if i >= hi || !bytes.Equal(p.name(i), id) {
+		return 0, false
+	}
+
+	offset := binary.BigEndian.Uint32(p.offsets[i*4:])
+	if offset&0x80000000 == 0 {
+		return int64(offset), true
+	}
+
+	at := int(offset&0x7fffffff) * 8
+	if at+8 > len(p.large) {
+		return 0, false
+	}
+
+	return int64(binary.BigEndian.Uint64(p.large[at:])), true
+}
+
+// read - object at the offset, deltas are applied to their bases, depth is the number of deltas built on it
+func (p *packFile) read(offset int64, store *objectStore, depth int) (*gitObject, error) {
+	if depth > maxDeltaDepth {
+		return nil, fmt.Errorf("Delta chain at %d of %s is too long", offset, p.path)
+	}
+
+	p.mx.Lock()
+	obj, ok := p.bases[offset]
+	p.mx.Unlock()
+	if ok {
+		return obj, nil
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(p.file, offset, 1<<62))
+
+	// type and size: 1TTTSSSS 1SSSSSSS ... 0SSSSSSS
+	b, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	kind := int(b>>4) & 7
+	size := int64(b & 0x0f)
+	for shift := uint(4); b&0x80 != 0; shift += 7 {
+		if b, err = reader.ReadByte(); err != nil {
+			return nil, err
+		}
+
+		size |= int64(b&0x7f) << shift
+	}
+
+	var base *gitObject
+	switch kind {
+	case objectOfsDelta:
+		// offset of the base back from this object
+		if b, err = reader.ReadByte(); err != nil {
+			return nil, err
+		}
+
+		back := int64(b & 0x7f)
+		for b&0x80 != 0 {
+			if b, err = reader.ReadByte(); err != nil {
+				return nil, err
+			}
+
+			back = ((back + 1) << 7) | int64(b&0x7f)
+		}
+
+		// the base goes before the delta, a corrupt offset must not lead to the object itself
+		if back <= 0 || back > offset {
+			return nil, fmt.Errorf("Invalid delta base at %d of %s", offset, p.path)
+		}
+
+		if base, err = p.read(offset-back, store, depth+1); err != nil {
+			return nil, err
+		}
+	case objectRefDelta:
+		id := make([]byte, 20)
+		if _, err := io.ReadFull(reader, id); err != nil {
+			return nil, err
+		}
+
+		if base, err = store.readDepth(hex.EncodeToString(id), depth+1); err != nil {
+			return nil, err
+		}
+	case objectCommit, objectTree, objectBlob, objectTag:
+	default:
+		return nil, fmt.Errorf("Unsupported object type %d in %s", kind, p.path)
+	}
+
+	zr, err := zlib.NewReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read %s: %v", p.path, err)
+	}
+
+	defer zr.Close()
+
+	if size > maxObjectSize || size > (p.size-offset)*maxDeflateRatio {
+		return nil, fmt.Errorf("Invalid size %d of the object at %d of %s", size, offset, p.path)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return nil, fmt.Errorf("Can't read %s: %v", p.path, err)
+	}
+
+	obj = &gitObject{kind: kind, data: data}
+	if base != nil {
+		if data, err = applyDelta(base.data, data); err != nil {
+			return nil, fmt.Errorf("Can't read %s: %v", p.path, err)
+		}
+
+		obj = &gitObject{kind: base.kind, data: data}
+	}
+
+	// objects of the delta chains are read again for every object which is built on them
+	if len(obj.data) > maxDeltaBaseSize {
+		return obj, nil
+	}
+
+	p.mx.Lock()
+	if len(p.bases) >= maxDeltaBases {
+		p.bases = make(map[int64]*gitObject)
+	}
+
+	p.bases[offset] = obj
+	p.mx.Unlock()
+
+	return obj, nil
+}
+
+// applyDelta - build the object from the base and the delta: sizes of the base and the result go first,
+// then instructions to copy a part of the base or to insert the bytes which follow
+func applyDelta(base, delta []byte) ([]byte, error) {
+	varint := func() int {
+		value, shift := 0, uint(0)
+		for len(delta) > 0 {
+			b := delta[0]
+			delta = delta[1:]
+			value |= int(b&0x7f) << shift
+			shift += 7
+			if b&0x80 == 0 {
+				break
+			}
+		}
+
+		return value
+	}
+
+	if varint() != len(base) {
+		return nil, fmt.Errorf("delta base size mismatch")
+	}
+
+	// an instruction copies the whole base at most or inserts less than itself
+	size := varint()
+	if size > maxObjectSize || size > len(delta)*(len(base)+1) {
+		return nil, fmt.Errorf("invalid delta result size %d", size)
+	}
+
+	out := make([]byte, 0, size)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+
+		if op&0x80 == 0 {
+			if op == 0 || int(op) > len(delta) {
+				return nil, fmt.Errorf("invalid delta")
+			}
+
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+			continue
+		}
+
+		// bits of the op tell which bytes of the offset and the size follow
+		offset, length := 0, 0
+		for i := uint(0); i < 7; i++ {
+			if op&(1<<i) == 0 {
+				continue
+			}
+
+			if len(delta) == 0 {
+				return nil, fmt.Errorf("invalid delta")
+			}
+
+			if i < 4 {
+				offset |= int(delta[0]) << (8 * i)
+			} else {
+				length |= int(delta[0]) << (8 * (i - 4))
+			}
+
+			delta = delta[1:]
+		}
+
+		if length == 0 {
+			length = 0x10000
+		}
+
+		if offset+length > len(base) {
+			return nil, fmt.Errorf("invalid delta")
+		}
+
+		out = append(out, base[offset:offset+length]...)
+	}
+
+	if len(out) != size {
+		return nil, fmt.Errorf("delta result size mismatch")
+	}
+
+	return out, nil
+}
+
+// gitSignature - author or committer of the commit
+type gitSignature struct {
+	Name  string
+	Email string
+	When  time.Time
+}
+
+// parseSignature - "Name <email> 1700000000 +0100"
+func parseSignature(value string) gitSignature {
+	sig := gitSignature{Name: value}
+	lt, gt := strings.IndexByte(value, '<'), strings.LastIndexByte(value, '>')
+	if lt < 0 || gt < lt {
+		return sig
+	}
+
+	sig.Name = strings.TrimSpace(value[:lt])
+	sig.Email = value[lt+1 : gt]
+
+	fields := strings.Fields(value[gt+1:])
+	if len(fields) != 2 {
+		return sig
+	}
+
+	sec, _ := strconv.ParseInt(fields[0], 10, 64)
+	zone := time.UTC
+	if tz, err := strconv.Atoi(fields[1]); err == nil && len(fields[1]) == 5 {
+		offset := (tz/100*60 + tz%100) * 60
+		zone = time.FixedZone("", offset)
+	}
+
+	sig.When = time.Unix(sec, 0).In(zone)
+	return sig
+}
+
+// gitCommit - parsed commit object
+type gitCommit struct {
+	Name      string
+	Tree      string
+	Parents   []string
+	Author    gitSignature
+	Committer gitSignature
+	Encoding  string
+	Signed    bool
+	Message   string
+}
+
+// parseCommit - headers of the commit, a blank line and the message
+func parseCommit(name string, data []byte) (*gitCommit, error) {
+	c := &gitCommit{Name: name}
+	text := string(data)
+	for text != "" {
+		eol := strings.IndexByte(text, '\n')
+		if eol < 0 {
+			eol = len(text)
+		}
+
+		line := text[:eol]
+		if eol < len(text) {
+			eol++
+		}
+
+		text = text[eol:]
+		if line == "" {
+			c.Message = text
+			break
+		}
+
+		// continuation of the multiline header like gpgsig
+		if strings.HasPrefix(line, " ") {
+			continue
+		}
+
+		key, value := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			key, value = line[:i], line[i+1:]
+		}
+
+		switch key {
+		case "tree":
+			c.Tree = value
+		case "parent":
+			c.Parents = append(c.Parents, value)
+		case "author":
+			c.Author = parseSignature(value)
+		case "committer":
+			c.Committer = parseSignature(value)
+		case "encoding":
+			c.Encoding = value
+		case "gpgsig", "gpgsig-sha256":
+			c.Signed = true
+		}
+	}
+
+	if !isObjectName(c.Tree) {
+		return nil, fmt.Errorf("Invalid commit %s", name)
+	}
+
+	return c, nil
+}
+
+// gitTreeEntry - file or folder of the tree
+type gitTreeEntry struct {
+	Mode uint32
+	Name string
+	Hash string
+}
+
+// Modes of the tree entries
+const (
+	modeTree    = 040000
+	modeSymlink = 0120000
+	modeGitlink = 0160000
+)
+
+// IsTree - the entry is a folder
+func (e gitTreeEntry) IsTree() bool {
+	return e.Mode&0170000 == modeTree
+}
+
+// IsBlob - the entry is a file or a symlink, submodules are commits of other repositories
+func (e gitTreeEntry) IsBlob() bool {
+	return !e.IsTree() && e.Mode&0170000 != modeGitlink
+}
+
+// parseTree - "<octal mode> <name>\0<20 bytes object name>" entries
+func parseTree(data []byte) ([]gitTreeEntry, error) {
+	entries := []gitTreeEntry{}
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if space < 0 || nul < space || nul+21 > len(data) {
+			return nil, fmt.Errorf("Invalid tree")
+		}
+
+		mode, err := strconv.ParseUint(string(data[:space]), 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid tree")
+		}
+
+		entries = append(entries, gitTreeEntry{
+			Mode: uint32(mode),
+			Name: string(data[space+1 : nul]),
+			Hash: hex.EncodeToString(data[nul+1 : nul+21]),
+		})
+		data = data[nul+21:]
+	}
+
+	return entries, nil
+}
+
+// parseTag - object the annotated tag points to and its type
+func parseTag(data []byte) (string, int) {
+	object, kind := "", 0
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			break
+		}
+
+		if strings.HasPrefix(line, "object ") {
+			object = strings.TrimPrefix(line, "object ")
+		} else if strings.HasPrefix(line, "type ") {
+			kind = objectTypes[strings.TrimPrefix(line, "type ")]
+		}
+	}
+
+	return object, kind
+}
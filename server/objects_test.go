@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// corruptPack - pack with the single object at the offset 12 indexed under the name
+func corruptPack(t *testing.T, name string, object []byte) *packFile {
+	file, err := ioutil.TempFile("", "rowi-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		file.Close()
+		os.Remove(file.Name())
+	})
+
+	pack := append([]byte("PACK\x00\x00\x00\x02\x00\x00\x00\x01"), object...)
+	if _, err := file.Write(pack); err != nil {
+		t.Fatal(err)
+	}
+
+	id, _ := hex.DecodeString(name)
+	p := &packFile{path: file.Name(), file: file, names: id, count: 1, size: int64(len(pack)),
+		bases: make(map[int64]*gitObject)}
+	for i := int(id[0]); i < len(p.fanout); i++ {
+		p.fanout[i] = 1
+	}
+
+	p.offsets = make([]byte, 4)
+	binary.BigEndian.PutUint32(p.offsets, 12)
+	return p
+}
+
+func TestPackDeltaLoops(t *testing.T) {
+	name := strings.Repeat("ab", 20)
+
+	// delta of the size 1 with the base 0 bytes back, which is the delta itself
+	ofs := corruptPack(t, name, []byte{0x61, 0x00})
+	if _, err := ofs.read(12, &objectStore{}, 0); err == nil || !strings.Contains(err.Error(), "Invalid delta base") {
+		t.Errorf("expected the invalid base, got %v", err)
+	}
+
+	// delta built on the object with its own name
+	id, _ := hex.DecodeString(name)
+	ref := corruptPack(t, name, append([]byte{0x71}, id...))
+	store := &objectStore{packs: []*packFile{ref}, cache: make(map[string]*gitObject)}
+	if _, err := store.read(name); err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Errorf("expected the loop to be stopped, got %v", err)
+	}
+}
+
+func TestObjectSizeLimits(t *testing.T) {
+	// blob of 1 TiB followed by a few compressed bytes
+	blob := corruptPack(t, strings.Repeat("cd", 20), []byte{0xb0, 0x80, 0x80, 0x80, 0x80, 0x80, 0x02, 0x78, 0x9c, 0x03, 0x00})
+	if _, err := blob.read(12, &objectStore{}, 0); err == nil || !strings.Contains(err.Error(), "Invalid size") {
+		t.Errorf("expected the size to be rejected, got %v", err)
+	}
+
+	// base of 3 bytes, the result of 1 GiB from a single copy
+	if _, err := applyDelta([]byte("abc"), []byte{0x03, 0x80, 0x80, 0x80, 0x80, 0x04, 0x91, 0x00, 0x03}); err == nil {
+		t.Error("expected the result size of the delta to be rejected")
+	}
+
+	if out, err := applyDelta([]byte("abc"), []byte{0x03, 0x04, 0x91, 0x01, 0x02, 0x02, 'x', 'y'}); string(out) != "bcxy" || err != nil {
+		t.Errorf("expected %q, got %q, %v", "bcxy", out, err)
+	}
+}
+
+func TestLoadPacksClosesRemovedPacks(t *testing.T) {
+	gitDir := fixtureRepo(t)
+	store, err := newObjectStore(filepath.Join(gitDir, "objects"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.packs) != 1 {
+		t.Fatalf("expected the pack of the fixture, got %d packs", len(store.packs))
+	}
+
+	old := store.packs[0]
+	cmd := exec.Command(gitBinary, "--git-dir", gitDir, "repack", "-a", "-d", "-q")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git repack: %v\n%s", err, out)
+	}
+
+	if err := store.loadPacks(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.packs) != 1 || store.packs[0] == old {
+		t.Fatalf("expected the new pack only, got %+v", store.packs)
+	}
+
+	if !old.isClosed() || old.file.Close() == nil {
+		t.Error("the removed pack is still open")
+	}
+
+	// objects read by a reader which still holds the removed pack are found in the new one
+	v1, err := newGitBackend(gitDir, GitBackendGo).RevParse("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.packs = append([]*packFile{old}, store.packs...)
+	if _, err := store.readType(v1, objectCommit); err != nil {
+		t.Errorf("can't read the commit: %v", err)
+	}
+}
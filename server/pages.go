@@ -0,0 +1,301 @@
+package server
+
+import (
+	"html"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// pageIndex - lookup tables of the pages found during a single scan of the docroot
+type pageIndex struct {
+	keys       map[string]string   // page key -> markdown file relative to the docroot
+	normalized map[string]string   // normalized page key -> page key
+	names      map[string][]string // normalized file name without extension -> page keys
+	files      map[string]bool     // all files of the docroot, used to check attachments
+}
+
+// pageKey - build url key of the page by its path relative to the docroot:
+// runbooks/db-failover.md -> runbooks/db-failover, runbooks/index.md -> runbooks, Home.md -> /
+// Empty key is returned for files which are not markdown.
+func pageKey(file string) string {
+	if strings.ToLower(path.Ext(file)) != ".md" {
+		return ""
+	}
+
+	dir, name := path.Split(file)
+	switch strings.ToLower(name) {
+	case "home.md", "index.md", "readme.md":
+		if dir == "" {
+			return "/"
+		}
+
+		return strings.TrimSuffix(dir, "/")
+	}
+
+	return strings.TrimSuffix(file, path.Ext(file))
+}
+
+// newPageIndex - build lookup tables for the list of files relative to the docroot
+func newPageIndex(files []string) *pageIndex {
+	index := &pageIndex{
+		keys:       make(map[string]string),
+		normalized: make(map[string]string),
+		names:      make(map[string][]string),
+		files:      make(map[string]bool),
+	}
+
+	sorted := append([]string{}, files...)
+	sort.Strings(sorted)
+	for _, f := range sorted {
+		index.files[f] = true
+		key := pageKey(f)
+		if key == "" || strings.HasPrefix(path.Base(f), "_") {
+			continue
+		}
+
+		// runbooks.md and runbooks/index.md claim the same url, the first one wins
+		if prev, ok := index.keys[key]; ok {
+			log.Warnf("Both %s and %s are served at /%s, %s is ignored", prev, f, key, f)
+			continue
+		}
+
+		index.keys[key] = f
+		index.normalized[normalizeName(key)] = key
+
+		// main page is known by its file name: [[Home]]
+		name := path.Base(key)
+		if key == "/" {
+			name = strings.TrimSuffix(path.Base(f), path.Ext(f))
+		}
+
+		name = normalizeName(name)
+		index.names[name] = append(index.names[name], key)
+	}
+
+	for name, keys := range index.names {
+		if len(keys) > 1 {
+			log.Warnf("Page name %q is ambiguous: %s", name, strings.Join(keys, ", "))
+		}
+	}
+
+	return index
+}
+
+// resolve - find the page key for the target markdown path referenced from the file.
+// Relative targets are resolved against the directory of the file, when nothing is
+// found there the target is looked up by its name only as GitHub wikis do.
+func (index *pageIndex) resolve(from, target string) (string, bool) {
+	var p string
+	if strings.HasPrefix(target, "/") {
+		p = strings.TrimPrefix(path.Clean(target), "/")
+	} else {
+		p = path.Join(path.Dir(from), target)
+	}
+
+	key := pageKey(p)
+	if _, ok := index.keys[key]; ok {
+		return key, true
+	}
+
+	if found, ok := index.resolveName(from, strings.TrimSuffix(path.Base(p), path.Ext(p))); ok {
+		return found, true
+	}
+
+	return key, false
+}
+
+// resolveName - find the page key by its name only
+func (index *pageIndex) resolveName(from, name string) (string, bool) {
+	// in case of the same file name in several directories prefer the closest one
+	candidates := index.names[normalizeName(path.Base(name))]
+	for _, candidate := range candidates {
+		if path.Dir(candidate) == path.Dir(from) {
+			return candidate, true
+		}
+	}
+
+	if len(candidates) > 0 {
+		return candidates[0], true
+	}
+
+	return "", false
+}
+
+// resolveWiki - find the page key for the target of [[Page Name]] link. GitHub treats spaces
+// and hyphens in page names the same way, so the target may be written either way.
+func (index *pageIndex) resolveWiki(from, target string) (string, bool) {
+	target = strings.Trim(strings.TrimSuffix(strings.TrimSpace(target), ".md"), "/")
+	if key, ok := index.normalized[normalizeName(target)]; ok {
+		return key, true
+	}
+
+	if key, ok := index.normalized[normalizeName(path.Join(path.Dir(from), target))]; ok {
+		return key, true
+	}
+
+	if key, ok := index.resolveName(from, target); ok {
+		return key, true
+	}
+
+	return strings.Replace(target, " ", "-", -1), false
+}
+
+// normalizeName - make the page name case and space insensitive: "Page Name" -> page-name
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Replace(name, " ", "-", -1))
+}
+
+// PageLink - link to another page or attachment found during rendering
+type PageLink struct {
+	Key          string // key of the target page or path of the attachment relative to the docroot
+	Fragment     string // #anchor of the link
+	IsFound      bool   // false in case if there is no such page or file
+	IsAttachment bool   // link to a file which is not a page
+}
+
+// localLink - resolve href of the local link which doesn't point to a markdown file: either
+// a page written without .md or an attachment. The second value is false for external links and anchors.
+func (index *pageIndex) localLink(from, href string) (PageLink, bool) {
+	u, err := url.Parse(html.UnescapeString(href))
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" || strings.ToLower(path.Ext(u.Path)) == ".md" {
+		return PageLink{}, false
+	}
+
+	var p string
+	if strings.HasPrefix(u.Path, "/") {
+		p = strings.TrimPrefix(path.Clean(u.Path), "/")
+	} else {
+		p = path.Join(path.Dir(from), u.Path)
+	}
+
+	if key := urlKey(p); index.keys[key] != "" {
+		return PageLink{Key: key, Fragment: u.Fragment, IsFound: true}, true
+	}
+
+	return PageLink{Key: p, Fragment: u.Fragment, IsFound: index.files[p], IsAttachment: true}, true
+}
+
+// URL - url of the link target
+func (l PageLink) URL() string {
+	return pageURL(l.Key, l.Fragment)
+}
+
+// PageRef - short reference to the page for lists of pages
+type PageRef struct {
+	Key   string `json:"key"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// rewrite - resolve href of the link to markdown file, the second value is false
+// in case if href doesn't point to a markdown file
+func (index *pageIndex) rewrite(from, href string) (PageLink, bool) {
+	u, err := url.Parse(html.UnescapeString(href))
+	if err != nil || u.Scheme != "" || u.Host != "" || strings.ToLower(path.Ext(u.Path)) != ".md" {
+		return PageLink{}, false
+	}
+
+	key, ok := index.resolve(from, u.Path)
+	return PageLink{Key: key, Fragment: u.Fragment, IsFound: ok}, true
+}
+
+// pageURL - url of the page by its key
+func pageURL(key, fragment string) string {
+	u := (&url.URL{Path: "/" + strings.TrimPrefix(key, "/")}).EscapedPath()
+	if fragment != "" {
+		u += "#" + (&url.URL{Fragment: fragment}).EscapedFragment()
+	}
+
+	return u
+}
+
+// urlKey - convert the request path into the page key: /runbooks/db-failover/ -> runbooks/db-failover
+func urlKey(p string) string {
+	key := strings.Trim(path.Clean("/"+p), "/")
+	if key == "" {
+		return "/"
+	}
+
+	return key
+}
+
+// pageActions - views of the page addressed as /<page>/<action>/<args>
+var pageActions = map[string]bool{
+	"_backlinks": true,
+	"_blame":     true,
+	"_changes":   true,
+	"_history":   true,
+	"_rev":       true,
+}
+
+// pageActionURL - url of the page view: runbooks/db-failover, _history -> /runbooks/db-failover/_history
+func pageActionURL(key, action string, args ...string) string {
+	return path.Join(append([]string{"/", key, action}, args...)...)
+}
+
+// splitPageAction - split the page key into the key of the page, the action and its arguments:
+// runbooks/db-failover/_backlinks -> runbooks/db-failover, _backlinks
+func splitPageAction(key string) (page, action string, args []string) {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		if !pageActions[part] {
+			continue
+		}
+
+		page = strings.Join(parts[:i], "/")
+		if page == "" {
+			page = "/"
+		}
+
+		return page, part, parts[i+1:]
+	}
+
+	return key, "", nil
+}
+
+// isHiddenPath - check if any element of the path starts with a dot
+func isHiddenPath(p string) bool {
+	for _, part := range strings.Split(p, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// buildBacklinks - build the reverse link graph of the pages
+func buildBacklinks(pages map[string]*Page) map[string][]PageRef {
+	sources := make(map[string]map[string]bool)
+	for key, page := range pages {
+		for _, link := range page.Links {
+			// links to the same page are not interesting
+			if !link.IsFound || link.IsAttachment || link.Key == key {
+				continue
+			}
+
+			if sources[link.Key] == nil {
+				sources[link.Key] = make(map[string]bool)
+			}
+
+			sources[link.Key][key] = true
+		}
+	}
+
+	backlinks := make(map[string][]PageRef)
+	for target, keys := range sources {
+		for _, key := range sortedKeys(keys) {
+			backlinks[target] = append(backlinks[target], PageRef{
+				Key:   key,
+				Title: pages[key].Title,
+				URL:   pageURL(key, ""),
+			})
+		}
+	}
+
+	return backlinks
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPageKey(t *testing.T) {
+	tests := map[string]string{
+		"Home.md":                  "/",
+		"README.md":                "/",
+		"notes.md":                 "notes",
+		"runbooks/db-failover.md":  "runbooks/db-failover",
+		"runbooks/index.md":        "runbooks",
+		"runbooks/db/Home.md":      "runbooks/db",
+		"runbooks/db/Failover.MD":  "runbooks/db/Failover",
+		"runbooks/diagram.png":     "",
+		"runbooks/db/home.md.orig": "",
+	}
+
+	for file, expected := range tests {
+		if key := pageKey(file); key != expected {
+			t.Errorf("pageKey(%q): expected %q, got %q", file, expected, key)
+		}
+	}
+}
+
+func TestURLKey(t *testing.T) {
+	tests := map[string]string{
+		"":                       "/",
+		"/":                      "/",
+		"/runbooks/db-failover/": "runbooks/db-failover",
+		"runbooks//db/../notes":  "runbooks/notes",
+		"/../../etc/passwd":      "etc/passwd",
+	}
+
+	for p, expected := range tests {
+		if key := urlKey(p); key != expected {
+			t.Errorf("urlKey(%q): expected %q, got %q", p, expected, key)
+		}
+	}
+}
+
+func TestBuildBacklinks(t *testing.T) {
+	pages := map[string]*Page{
+		"/": {Title: "Home", Links: []PageLink{
+			{Key: "runbooks/db", IsFound: true},
+			{Key: "runbooks/db", Fragment: "restore", IsFound: true},
+			{Key: "logo.png", IsFound: true, IsAttachment: true},
+			{Key: "missing"},
+		}},
+		"runbooks/db": {Title: "DB", Links: []PageLink{
+			{Key: "runbooks/db", Fragment: "failover", IsFound: true},
+			{Key: "/", IsFound: true},
+		}},
+		"runbooks/cache": {Title: "Cache", Links: []PageLink{{Key: "runbooks/db", IsFound: true}}},
+	}
+
+	expected := map[string][]PageRef{
+		"/": {{Key: "runbooks/db", Title: "DB", URL: "/runbooks/db"}},
+		"runbooks/db": {
+			{Key: "/", Title: "Home", URL: "/"},
+			{Key: "runbooks/cache", Title: "Cache", URL: "/runbooks/cache"},
+		},
+	}
+
+	if backlinks := buildBacklinks(pages); !reflect.DeepEqual(backlinks, expected) {
+		t.Errorf("expected %+v, got %+v", expected, backlinks)
+	}
+}
+
+func TestGetBacklinks(t *testing.T) {
+	r := NewRenderer(writeDocroot(t, map[string]string{
+		"Home.md":        "# Home\n\nSee [[Notes]]\n",
+		"notes.md":       "# Notes\n",
+		"runbooks/db.md": "# DB\n\n[Notes](../notes.md) [DB](db.md)\n",
+		"on call?.md":    "# On call\n\n[Notes](notes.md)\n",
+	}), make(chan interface{}, 1))
+	r.scanStorage()
+
+	backlinks, ok := r.GetBacklinks("notes")
+	expected := []PageRef{
+		{Key: "/", Title: "Home", URL: "/"},
+		{Key: "on call?", Title: "On call", URL: "/on%20call%3F"},
+		{Key: "runbooks/db", Title: "DB", URL: "/runbooks/db"},
+	}
+	if !ok || !reflect.DeepEqual(backlinks, expected) {
+		t.Errorf("expected %+v, got %+v, %v", expected, backlinks, ok)
+	}
+
+	if page, _ := r.GetPage("notes"); !reflect.DeepEqual(page.Backlinks, expected) {
+		t.Errorf("unexpected backlinks of the page: %+v", page.Backlinks)
+	}
+
+	if backlinks, ok := r.GetBacklinks("runbooks/db"); !ok || len(backlinks) != 0 {
+		t.Errorf("expected no backlinks of the page linking to itself, got %+v", backlinks)
+	}
+
+	if _, ok := r.GetBacklinks("runbooks/missing"); ok {
+		t.Error("expected no backlinks of a missing page")
+	}
+}
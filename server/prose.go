@@ -0,0 +1,71 @@
+package server
+
+import (
+	"html/template"
+	"regexp"
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// proseTokenRe - html tags, words and runs of whitespace of the rendered page
+var proseTokenRe = regexp.MustCompile(`<[^>]*>|[^<\s]+|\s+`)
+
+// PageChanges - revisions of the page compared word by word
+type PageChanges struct {
+	From *GitLog // nil when the page did not exist before
+	To   *GitLog
+}
+
+// proseDiff - word level diff of two rendered pages, the structure of the new one is kept and the words
+// are wrapped into <ins> and <del>
+func proseDiff(old, new string) template.HTML {
+	tokens := newTokenRunes()
+	dmp := diffmatchpatch.New()
+	diffs := dmp.DiffMainRunes(tokens.encode(proseTokenRe.FindAllString(old, -1)),
+		tokens.encode(proseTokenRe.FindAllString(new, -1)), false)
+	diffs = dmp.DiffCleanupSemantic(diffs)
+
+	var out strings.Builder
+	for _, diff := range diffs {
+		var words strings.Builder
+		flush := func(tag string) {
+			if strings.TrimSpace(words.String()) != "" {
+				out.WriteString("<" + tag + ">" + words.String() + "</" + tag + ">")
+			} else {
+				out.WriteString(words.String())
+			}
+
+			words.Reset()
+		}
+
+		for _, r := range diff.Text {
+			value := tokens.decode(r)
+			switch diff.Type {
+			case diffmatchpatch.DiffEqual:
+				out.WriteString(value)
+			case diffmatchpatch.DiffDelete:
+				// tags of the old revision are dropped, its words go next to the new ones
+				if !strings.HasPrefix(value, "<") {
+					words.WriteString(value)
+				}
+			case diffmatchpatch.DiffInsert:
+				if strings.HasPrefix(value, "<") {
+					flush("ins")
+					out.WriteString(value)
+				} else {
+					words.WriteString(value)
+				}
+			}
+		}
+
+		switch diff.Type {
+		case diffmatchpatch.DiffDelete:
+			flush("del")
+		case diffmatchpatch.DiffInsert:
+			flush("ins")
+		}
+	}
+
+	return template.HTML(out.String())
+}
@@ -0,0 +1,18 @@
+package server
+
+import "testing"
+
+func TestProseDiff(t *testing.T) {
+	old := "<h1>Failover</h1>\n<p>Stop the <b>primary</b> database now.</p>"
+	new := "<h1>Failover</h1>\n<p>Stop the <b>primary</b> cluster now.</p>\n<p>Then wait.</p>"
+
+	expected := "<h1>Failover</h1>\n<p>Stop the <b>primary</b> <del>database</del><ins>cluster</ins> now.</p>" +
+		"\n<p><ins>Then wait.</ins></p>"
+	if got := string(proseDiff(old, new)); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	if got := string(proseDiff(old, old)); got != old {
+		t.Errorf("expected unchanged content, got %q", got)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// buildRedirects - old page keys -> keys of the current pages, old names come from renames of the history,
+// newest first, and from aliases of the front matter. Existing pages are never redirected.
+func buildRedirects(pages map[string]*Page, renames []FileRename) map[string]string {
+	renamed := make(map[string]string)
+	for i := len(renames) - 1; i >= 0; i-- {
+		old, new := pageKey(renames[i].OldPath), pageKey(renames[i].NewPath)
+		if old != "" && new != "" && old != new {
+			renamed[old] = new
+		}
+	}
+
+	redirects := make(map[string]string)
+	for old := range renamed {
+		if _, ok := pages[old]; ok {
+			continue
+		}
+
+		// the page could be renamed several times, the chain can't be longer than the number of renames
+		target := old
+		for i := 0; i < len(renamed); i++ {
+			next, ok := renamed[target]
+			if !ok {
+				break
+			}
+
+			target = next
+			if _, ok := pages[target]; ok {
+				break
+			}
+		}
+
+		// pages deleted after the rename are not redirected
+		if _, ok := pages[target]; ok && target != old {
+			redirects[old] = target
+		}
+	}
+
+	// aliases are declared explicitly, so they take over the names from the history
+	keys := make([]string, 0, len(pages))
+	for key := range pages {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	aliases := make(map[string]string)
+	for _, key := range keys {
+		for _, alias := range pages[key].Meta.Aliases {
+			old := aliasKey(alias)
+			if _, ok := pages[old]; ok {
+				if old != key {
+					log.Warnf("Alias %q of %s is ignored, there is a page at %s", alias, pageURL(key, ""), pageURL(old, ""))
+				}
+
+				continue
+			}
+
+			if prev, ok := aliases[old]; ok {
+				log.Warnf("Alias %q is claimed by both %s and %s, %s is ignored", alias, pageURL(prev, ""), pageURL(key, ""),
+					pageURL(key, ""))
+				continue
+			}
+
+			aliases[old] = key
+			redirects[old] = key
+		}
+	}
+
+	return redirects
+}
+
+// aliasKey - page key of the alias from the front matter: "DB Failover" -> DB-Failover,
+// /old/runbook.md -> old/runbook
+func aliasKey(alias string) string {
+	alias = strings.Replace(strings.TrimSpace(alias), " ", "-", -1)
+	if strings.ToLower(path.Ext(alias)) == ".md" {
+		return pageKey(strings.Trim(path.Clean("/"+alias), "/"))
+	}
+
+	return urlKey(alias)
+}
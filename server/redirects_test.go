@@ -0,0 +1,51 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildRedirects(t *testing.T) {
+	pages := map[string]*Page{
+		"/":                    {Path: "Home.md"},
+		"runbooks/db-failover": {Path: "runbooks/db-failover.md", Meta: PageMeta{Aliases: []string{"Failover", "/old/db.md", "notes"}}},
+		"runbooks/notes":       {Path: "runbooks/notes.md", Meta: PageMeta{Aliases: []string{"failover"}}},
+		"notes":                {Path: "notes.md"},
+	}
+
+	// newest first: notes.md -> misc.md -> runbooks/notes.md, then a new notes.md
+	renames := []FileRename{
+		{OldPath: "drafts.md", NewPath: "gone.md"},
+		{OldPath: "misc.md", NewPath: "runbooks/notes.md"},
+		{OldPath: "notes.md", NewPath: "misc.md"},
+		{OldPath: "db.md", NewPath: "runbooks/db-failover.md"},
+		{OldPath: "logo.png", NewPath: "images/logo.png"},
+	}
+
+	expected := map[string]string{
+		"misc":     "runbooks/notes",
+		"db":       "runbooks/db-failover",
+		"Failover": "runbooks/db-failover",
+		"old/db":   "runbooks/db-failover",
+		"failover": "runbooks/notes",
+	}
+
+	if redirects := buildRedirects(pages, renames); !reflect.DeepEqual(redirects, expected) {
+		t.Errorf("expected %v, got %v", expected, redirects)
+	}
+}
+
+func TestAliasKey(t *testing.T) {
+	tests := map[string]string{
+		"DB Failover":           "DB-Failover",
+		"/old/runbook.md":       "old/runbook",
+		"runbooks/index.md":     "runbooks",
+		" /runbooks/old-name/ ": "runbooks/old-name",
+	}
+
+	for alias, expected := range tests {
+		if key := aliasKey(alias); key != expected {
+			t.Errorf("aliasKey(%q): expected %q, got %q", alias, expected, key)
+		}
+	}
+}
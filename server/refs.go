@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sync"
+)
+
+// maxSnapshots - number of wiki snapshots at other refs kept in memory
+const maxSnapshots = 8
+
+// dateRefRe - refs which look like dates are resolved to the last commit before the date
+var dateRefRe = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}([ T]\d{2}:\d{2}(:\d{2})?)?([+-]\d{2}:?\d{2}|Z)?$`)
+
+// WikiRef - branch, tag, commit or date the wiki is browsed at
+type WikiRef struct {
+	Name   string  // as the user typed it
+	Commit *GitLog // commit the ref points to
+}
+
+// URL - prefix of the pages urls at the ref
+func (r WikiRef) URL() string {
+	return "/_ref/" + url.PathEscape(r.Name)
+}
+
+// snapshot - renderer of the wiki at the commit, built once on the first request
+type snapshot struct {
+	once     sync.Once
+	renderer *Renderer
+	err      error
+}
+
+// snapshots - renderers of the wiki at other commits, they never touch the live one
+type snapshots struct {
+	items map[string]*snapshot
+	order []string // commits from the oldest to the most recently built
+	mx    sync.Mutex
+}
+
+// ResolveRef - commit of the branch, tag, commit or date
+func (r *Renderer) ResolveRef(ref string) (*WikiRef, error) {
+	commit, err := r.ResolveRevision(ref)
+	if _, ok := err.(RevisionError); ok && dateRefRe.MatchString(ref) {
+		var commits []GitLog
+		commits, err = r.backend.Log(LogQuery{Revisions: []string{r.head()}, Until: ref, MaxCount: 1})
+		commit = ""
+		if len(commits) > 0 {
+			commit = commits[0].Commit
+		}
+	}
+
+	if err == ErrGitTimeout {
+		return nil, err
+	} else if err != nil || commit == "" || commit == emptyTree {
+		return nil, fmt.Errorf("Can't find the ref %s", ref)
+	}
+
+	revisionLog, err := r.getCommitLog(commit)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WikiRef{Name: ref, Commit: revisionLog}, nil
+}
+
+// Snapshot - renderer of the whole wiki read from the tree of the commit
+func (r *Renderer) Snapshot(commit string) (*Renderer, error) {
+	r.snapshots.mx.Lock()
+	if r.snapshots.items == nil {
+		r.snapshots.items = make(map[string]*snapshot)
+	}
+
+	item, ok := r.snapshots.items[commit]
+	if !ok {
+		item = &snapshot{}
+		r.snapshots.items[commit] = item
+		r.snapshots.order = append(r.snapshots.order, commit)
+		if len(r.snapshots.order) > maxSnapshots {
+			delete(r.snapshots.items, r.snapshots.order[0])
+			r.snapshots.order = r.snapshots.order[1:]
+		}
+	}
+	r.snapshots.mx.Unlock()
+
+	// concurrent requests of the same commit wait for a single scan
+	item.once.Do(func() {
+		storage, err := newGitStorage(r, commit)
+		if err != nil {
+			item.err = err
+			return
+		}
+
+		item.renderer = &Renderer{
+			contents:     make(map[string]*Page),
+			path:         r.path,
+			gitDir:       r.gitDir,
+			backend:      r.backend,
+			history:      r.history,
+			relativePath: r.relativePath,
+			storage:      storage,
+			revision:     commit,
+		}
+		item.renderer.scanStorage()
+	})
+
+	if item.err != nil {
+		// the failure is not cached, the next request tries again
+		r.snapshots.mx.Lock()
+		if r.snapshots.items[commit] == item {
+			delete(r.snapshots.items, commit)
+			for i, c := range r.snapshots.order {
+				if c == commit {
+					r.snapshots.order = append(r.snapshots.order[:i], r.snapshots.order[i+1:]...)
+					break
+				}
+			}
+		}
+		r.snapshots.mx.Unlock()
+	}
+
+	return item.renderer, item.err
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestDateRefRe(t *testing.T) {
+	for _, ref := range []string{"2024-01-01", "2024-01-01 10:00", "2024-01-01T10:00:00Z", "2024-01-01T10:00:00+02:00"} {
+		if !dateRefRe.MatchString(ref) {
+			t.Errorf("%s is expected to be a date", ref)
+		}
+	}
+
+	for _, ref := range []string{"v2.3", "release-2023", "2024-01-01-hotfix", "master"} {
+		if dateRefRe.MatchString(ref) {
+			t.Errorf("%s is not expected to be a date", ref)
+		}
+	}
+}
+
+func TestWikiRefURL(t *testing.T) {
+	if url := (WikiRef{Name: "feature/new docs"}).URL(); url != "/_ref/feature%2Fnew%20docs" {
+		t.Errorf("unexpected url: %s", url)
+	}
+}
+
+func TestResolveRef(t *testing.T) {
+	r := NewRenderer(filepath.Dir(fixtureRepo(t)), make(chan interface{}, 1))
+	r.scanStorage()
+
+	tests := map[string]string{
+		"v1":                        `Move notes into the "runbooks" folder`,
+		"feature":                   "Edit home",
+		"HEAD~1":                    "Rename the db runbook and the home page",
+		"2024-01-02T12:00:00+02:00": "Edit notes... and add the db runbook",
+		"2024-01-05 12:00+02:00":    "Edit db runbook",
+	}
+
+	for name, subject := range tests {
+		ref, err := r.ResolveRef(name)
+		if err != nil {
+			t.Errorf("ResolveRef(%q): %v", name, err)
+			continue
+		}
+
+		if ref.Name != name || ref.Commit.Subject != subject {
+			t.Errorf("ResolveRef(%q): expected %q, got %+v", name, subject, ref.Commit)
+		}
+	}
+
+	for _, name := range []string{"missing", "2023-12-31", "--output=x"} {
+		if _, err := r.ResolveRef(name); err == nil || gitErrorStatus(err, http.StatusNotFound) != http.StatusNotFound {
+			t.Errorf("ResolveRef(%q): expected the ref not to be found, got %v", name, err)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	r := NewRenderer(filepath.Dir(fixtureRepo(t)), make(chan interface{}, 1))
+	r.scanStorage()
+
+	ref, err := r.ResolveRef("v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := r.Snapshot(ref.Commit.Commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again, _ := r.Snapshot(ref.Commit.Commit); again != snapshot {
+		t.Error("expected the snapshot to be built once")
+	}
+
+	// the database runbook was renamed after the release
+	if _, err := snapshot.GetPage("runbooks/db"); err != nil {
+		t.Errorf("expected the page of the release: %v", err)
+	}
+
+	if _, err := snapshot.GetPage("runbooks/database"); err == nil {
+		t.Error("expected no page renamed after the release")
+	}
+
+	if logo, err := snapshot.ReadFile("logo.png"); string(logo) != "\x89PNG\r\n\x1a\n\x00\x00binary" || err != nil {
+		t.Errorf("unexpected attachment of the release: %q, %v", logo, err)
+	}
+
+	// the live wiki stays at HEAD
+	if r.head() != "HEAD" {
+		t.Errorf("unexpected head of the live wiki: %s", r.head())
+	}
+
+	if _, err := r.GetPage("runbooks/database"); err != nil {
+		t.Errorf("expected the live page: %v", err)
+	}
+
+	if _, err := r.GetPage("runbooks/db"); err == nil {
+		t.Error("expected no live page of the release")
+	}
+
+	commits, err := r.backend.Log(LogQuery{Revisions: []string{"HEAD"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// snapshots of other commits push the release out of the cache
+	others := []string{}
+	for _, commit := range commits {
+		if commit.Commit != ref.Commit.Commit && len(others) < maxSnapshots {
+			others = append(others, commit.Commit)
+		}
+	}
+
+	for _, commit := range others {
+		if _, err := r.Snapshot(commit); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(others) != maxSnapshots || len(r.snapshots.items) != maxSnapshots || r.snapshots.items[ref.Commit.Commit] != nil {
+		t.Errorf("expected %d snapshots without the release, got %v", maxSnapshots, r.snapshots.order)
+	}
+
+	if again, _ := r.Snapshot(others[0]); again != r.snapshots.items[others[0]].renderer {
+		t.Error("expected the cached snapshot")
+	}
+}
@@ -1,34 +1,46 @@
 package server
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	log "github.com/Sirupsen/logrus"
 	"github.com/rjeczalik/notify"
 	"github.com/shurcooL/github_flavored_markdown"
+	"html"
 	"html/template"
-	"io"
-	"io/ioutil"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Renderer - type which renderer md to html files
 type Renderer struct {
-	address         string           // address of http-server
-	path            string           // path to md-files
-	page            CommonPage       // page of Content
-	message         chan interface{} // channel for sending update information
-	relativePath    string           // RelativePath in case if server has this option set
-	contents        map[string]*Page // set of all available pages
-	isMainPageExist bool             // set false in case of no index page: home.md, index.md and README.md
+	address         string               // address of http-server
+	path            string               // path to md-files
+	page            CommonPage           // page of Content
+	message         chan interface{}     // channel for sending update information
+	relativePath    string               // RelativePath in case if server has this option set
+	storage         Storage              // source of the files, the docroot or a git tree
+	revision        string               // commit of the git tree, empty for the docroot
+	gitDir          string               // git repository, .git of the docroot or a bare repository
+	backend         GitBackend           // reads the history of gitDir
+	branch          string               // branch served from a bare repository, empty for the docroot
+	snapshots       snapshots            // renderers of the wiki at other refs
+	history         *historyCache        // renames and authorship by commit, shared with the snapshots
+	scanMx          sync.Mutex           // scans of the watchers and webhooks don't overlap
+	contents        map[string]*Page     // set of all available pages
+	index           *pageIndex           // lookup tables of the last scan, used to resolve links
+	search          *searchIndex         // full-text index of all pages
+	backlinks       map[string][]PageRef // page key -> pages which link to it
+	redirects       map[string]string    // old key of a renamed page or an alias -> key of the page
+	brokenLinks     []BrokenLinks        // links to missing pages, anchors and attachments
+	deleted         []DeletedPage        // pages which are gone from the tree, recently deleted first
+	isMainPageExist bool                 // set false in case of no index page: home.md, index.md and README.md
+	mx              sync.RWMutex
 }
 
 // Page - type to keep page-related information
@@ -36,18 +48,44 @@ type Page struct {
 	Content  template.HTML
 	Title    string
 	EditLink string
+	Path     string        // path of the source file relative to the docroot
+	Meta     PageMeta      // metadata from the front matter
+	TOC      []*TOCEntry   // heading hierarchy of the page
+	TOCHTML  template.HTML // rendered table of contents
+	Links    []PageLink    // links to other pages
+
+	LastModifiedBy string   // Author of the last commit which changed the page
+	LastModifiedAt string   // Date of the last commit which changed the page
+	Contributors   []string // Most active authors of the page
+}
+
+// Key - url key of the page
+func (p *Page) Key() string {
+	return pageKey(p.Path)
+}
+
+// ActionURL - url of the page view like _history
+func (p *Page) ActionURL(action string, args ...string) string {
+	return pageActionURL(p.Key(), action, args...)
 }
 
 // CommonPage - type to keep information about all pages
 type CommonPage struct {
-	Sidebar        Page   // Sidebar html-Content
-	Header         Page   // Header html-Content
-	Footer         Page   // Footer html-Content
-	Content        *Page  // All page-related content
-	LastModifiedBy string // User who modified this repo last time
-	LastModifiedAt string // Date when this repo was modified last time
-	IsCustomCSS    bool   // If doc includes custom css
-	IsCustomJS     bool   // If doc includes custom js
+	Sidebar        Page          // Sidebar html-Content
+	Header         Page          // Header html-Content
+	Footer         Page          // Footer html-Content
+	Content        *Page         // All page-related content
+	LastModifiedBy string        // User who modified this repo last time
+	LastModifiedAt string        // Date when this repo was modified last time
+	IsCustomCSS    bool          // If doc includes custom css
+	IsCustomJS     bool          // If doc includes custom js
+	IsGitRepo      bool          // If docroot is a git repository, so history is available
+	Revision       *GitLog       // Commit of the page in case of an old revision is shown
+	Changes        *PageChanges  // Compared revisions in case of the word level diff is shown
+	Ref            *WikiRef      // Ref the whole wiki is browsed at, nil for the live wiki
+	Mirror         *MirrorStatus // State of the mirror of the remote repository if rowi syncs it
+	Backlinks      []PageRef     // Pages which link to this page
+	Deleted        *DeletedPage  // Deleted page in case of its last version is shown
 	RelativePath   string
 }
 
@@ -64,7 +102,7 @@ type GitLog struct {
 	AbbreviatedTree      string     `json:"abbreviated_tree"`
 	Parent               string     `json:"parent"`
 	AbbreviatedParent    string     `json:"abbreviated_parent"`
-	Refs                 string     `json :"refs"`
+	Refs                 string     `json:"refs"`
 	Encoding             string     `json:"encoding"`
 	Subject              string     `json:"subject"`
 	SanitizedSubjectLine string     `json:"sanitized_subject_line"`
@@ -75,6 +113,7 @@ type GitLog struct {
 	SignerKey            string     `json:"signer_key"`
 	Author               GitLogUser `json:"author"`
 	Commiter             GitLogUser `json:"commiter"`
+	Files                []string   `json:"-"` // files changed by the commit if the log query asks for them
 }
 
 // NewRenderer - create an instance of renderer
@@ -85,35 +124,104 @@ func NewRenderer(path string, message chan interface{}) *Renderer {
 		path:         path,
 		message:      message,
 		relativePath: "",
+		storage:      fsStorage{root: path},
+		gitDir:       filepath.Join(path, ".git"),
+		backend:      newGitBackend(filepath.Join(path, ".git"), GitBackendAuto),
+		history:      &historyCache{},
+	}
+}
+
+// NewBareRenderer - create an instance of renderer which reads files of the branch from a bare repository,
+// HEAD of the repository is served if the branch is empty
+func NewBareRenderer(path, branch string, message chan interface{}) *Renderer {
+	if branch == "" {
+		branch = "HEAD"
+	}
+
+	return &Renderer{
+		contents: make(map[string]*Page),
+		path:     path,
+		message:  message,
+		gitDir:   path,
+		backend:  newGitBackend(path, GitBackendAuto),
+		history:  &historyCache{},
+		branch:   branch,
 	}
 }
 
-// addContent - parse Content from one of main files: home.md, index.md or README.md
-func (r *Renderer) addContent(path string) (page Page, err error) {
+// addContent - parse Content of the markdown file, path is relative to the docroot
+func (r *Renderer) addContent(storage Storage, path string, index *pageIndex) (page Page, err error) {
 	var bts []byte
-	bts, err = ioutil.ReadFile(path)
+	bts, err = storage.ReadFile(path)
 	if err != nil {
 		return
 	}
 
+	return r.renderContent(path, bts, index), nil
+}
+
+// renderContent - render markdown source of the file, path is relative to the docroot
+// and is used to resolve relative links
+func (r *Renderer) renderContent(path string, bts []byte, index *pageIndex) Page {
+	meta, bts, err := splitFrontMatter(bts)
+	if err != nil {
+		log.Warnf("Can't parse front matter of %s: %v", path, err)
+	}
+
 	bts = github_flavored_markdown.Markdown(bts)
 	str := string(bts)
 
-	// stripping .md from urls /Home.md -> /Home
-	mdLinkRe := regexp.MustCompile(`<a href="(.*)\.md`)
-	matches := mdLinkRe.FindAllStringSubmatch(str, -1)
-	for _, row := range matches {
-		fmt.Println(row[1])
-		str = strings.Replace(str, row[0], fmt.Sprintf(`<a href="%s`, row[1]), -1)
-	}
+	// rewriting links to other markdown files into page urls: ../design/Home.md -> /design/Home
+	var links []PageLink
+	mdLinkRe := regexp.MustCompile(`<a href="([^"]*)"`)
+	str = mdLinkRe.ReplaceAllStringFunc(str, func(link string) string {
+		href := mdLinkRe.FindStringSubmatch(link)[1]
+		target, ok := index.rewrite(path, href)
+		if !ok {
+			target, ok = index.localLink(path, href)
+		}
+
+		if ok {
+			links = append(links, target)
+			return fmt.Sprintf(`<a href="%s"`, html.EscapeString(target.URL()))
+		}
+
+		if strings.HasPrefix(href, "#") {
+			links = append(links, PageLink{Key: pageKey(path), Fragment: html.UnescapeString(href[1:]), IsFound: true})
+		}
+
+		return link
+	})
+
+	// images get absolute urls of the attachments, pages are shown at other urls than their folders like
+	// /runbooks, /runbooks/_rev/<sha> or /_deleted/runbooks/Home.md
+	imgRe := regexp.MustCompile(`<img src="([^"]*)"`)
+	str = imgRe.ReplaceAllStringFunc(str, func(img string) string {
+		target, ok := index.localLink(path, imgRe.FindStringSubmatch(img)[1])
+		if !ok {
+			return img
+		}
+
+		links = append(links, target)
+		return fmt.Sprintf(`<img src="%s"`, html.EscapeString(target.URL()))
+	})
+
+	str, wikiLinks := renderWikiLinks(str, path, index)
+	links = append(links, wikiLinks...)
+
+	toc := buildTOC(str)
+	tocHTML := renderTOC(toc)
+	str = insertTOC(str, tocHTML)
 
 	//<title> tag of the page should be the first H1 in the markdown
 	titleLinRe := regexp.MustCompile(`(?Us)(<h1[^>]*>.*</h1>)`)
-	matches = titleLinRe.FindAllStringSubmatch(str, -1)
+	matches := titleLinRe.FindAllStringSubmatch(str, -1)
 
-	title := strings.TrimRight(filepath.Base(path), ".md")
+	title := strings.TrimSuffix(filepath.Base(path), ".md")
 	editLink := fmt.Sprintf("%s/_edit", title)
-	if len(matches) > 0 {
+	if meta.Title != "" {
+		title = meta.Title
+	} else if len(matches) > 0 {
 		doc, err := goquery.NewDocumentFromReader(strings.NewReader(matches[0][1]))
 		if err == nil {
 			title = doc.Selection.Text()
@@ -124,16 +232,23 @@ func (r *Renderer) addContent(path string) (page Page, err error) {
 		Title:    title,
 		Content:  template.HTML(str),
 		EditLink: editLink,
-	}, nil
+		Path:     path,
+		Meta:     meta,
+		TOC:      toc,
+		TOCHTML:  tocHTML,
+		Links:    links,
+	}
 }
 
 // updateWatcher - cycle for monitoring changes in filesystem
 func (r *Renderer) updateWatcher() {
 	dataCh := make(chan notify.EventInfo, 1000)
-	notify.Watch(r.path, dataCh, notify.All)
+	// the "..." suffix makes the watch recursive
+	notify.Watch(filepath.Join(r.path, "..."), dataCh, notify.All)
 	defer notify.Stop(dataCh)
 	var isStop, isData bool
 
+	gitDir := string(filepath.Separator) + ".git" + string(filepath.Separator)
 	updateCh := time.NewTicker(time.Second * 5).C
 	// monitoring cycle
 	for {
@@ -141,8 +256,11 @@ func (r *Renderer) updateWatcher() {
 		isStop = false
 		for !isStop {
 			select {
-			case <-dataCh:
-				isData = true
+			case ei := <-dataCh:
+				// git internals change on every fetch, only the checked out files matter
+				if !strings.Contains(ei.Path(), gitDir) {
+					isData = true
+				}
 			case <-time.After(time.Millisecond * 100):
 				isStop = true
 			}
@@ -158,72 +276,317 @@ func (r *Renderer) updateWatcher() {
 
 // GetPage - return page content
 func (r *Renderer) GetPage(docPath string) (CommonPage, error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
 	if _, ok := r.contents[docPath]; !ok {
 		return CommonPage{}, fmt.Errorf("Can't find the page")
 	}
 
 	// build page with data
+	page := r.commonPage()
+	page.Content = r.contents[docPath]
+	page.Backlinks = r.backlinks[docPath]
+	return page, nil
+}
+
+// commonPage - parts shared by all pages, the caller holds the lock
+func (r *Renderer) commonPage() CommonPage {
 	return CommonPage{
 		Header:         r.page.Header,
 		Footer:         r.page.Footer,
 		Sidebar:        r.page.Sidebar,
-		Content:        r.contents[docPath],
 		IsCustomCSS:    r.page.IsCustomCSS,
 		IsCustomJS:     r.page.IsCustomJS,
+		IsGitRepo:      r.page.IsGitRepo,
 		LastModifiedAt: r.page.LastModifiedAt,
 		LastModifiedBy: r.page.LastModifiedBy,
-	}, nil
+	}
+}
+
+// GetDeletedPages - pages which existed in the history but are gone from the tree, recently deleted first
+func (r *Renderer) GetDeletedPages() []DeletedPage {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	return r.deleted
+}
+
+// GetDeletedPage - last version of the deleted page, it's read from the parent of the commit which deleted it
+func (r *Renderer) GetDeletedPage(file string) (CommonPage, error) {
+	r.mx.RLock()
+	page := r.commonPage()
+	index := r.index
+	for i := range r.deleted {
+		if r.deleted[i].Path == file {
+			deleted := r.deleted[i]
+			page.Deleted = &deleted
+			break
+		}
+	}
+	r.mx.RUnlock()
+
+	if page.Deleted == nil {
+		return page, fmt.Errorf("Can't find the deleted page %s", file)
+	}
+
+	parents := strings.Fields(page.Deleted.Commit.Parent)
+	if len(parents) == 0 {
+		return page, fmt.Errorf("Can't find the last version of %s", file)
+	}
+
+	bts, err := r.backend.Show(parents[0], file)
+	if err == ErrGitTimeout {
+		return page, err
+	} else if err != nil {
+		return page, fmt.Errorf("Can't find the last version of %s", file)
+	}
+
+	content := r.renderContent(file, bts, index)
+	content.EditLink = ""
+	page.Content = &content
+
+	return page, nil
+}
+
+// GetRedirect - key of the page which was renamed from the key or declares it as an alias, false if the
+// key is a page itself or is not known
+func (r *Renderer) GetRedirect(key string) (string, bool) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	if _, ok := r.contents[key]; ok {
+		return "", false
+	}
+
+	target, ok := r.redirects[key]
+	return target, ok
+}
+
+// GetPageRevision - return page content as it was in the revision, file is the path of
+// the page in that revision in case if it was renamed since then
+func (r *Renderer) GetPageRevision(docPath, revision, file string) (CommonPage, error) {
+	page, err := r.GetPage(docPath)
+	if err != nil {
+		return page, err
+	}
+
+	if file == "" {
+		file = page.Content.Path
+	}
+
+	if pageKey(file) == "" {
+		return page, fmt.Errorf("%s is not a page", file)
+	}
+
+	commit, err := r.ResolveRevision(revision)
+	if err != nil {
+		return page, err
+	}
+
+	bts, err := r.backend.Show(commit, file)
+	if err == ErrGitTimeout {
+		return page, err
+	} else if err != nil {
+		return page, fmt.Errorf("Can't find %s in %s", file, revision)
+	}
+
+	revisionLog, err := r.getCommitLog(commit)
+	if err != nil {
+		return page, err
+	}
+
+	r.mx.RLock()
+	index := r.index
+	r.mx.RUnlock()
+
+	content := r.renderContent(file, bts, index)
+	// links of the old revision lead to the current page
+	content.Path = page.Content.Path
+	content.EditLink = ""
+	page.Content = &content
+	page.Revision = revisionLog
+	page.Backlinks = nil
+
+	return page, nil
+}
+
+// GetPageChanges - word level diff of the page rendered at two revisions, prevFile and file are paths of the
+// page in the first and the second revision
+func (r *Renderer) GetPageChanges(docPath, first, second, prevFile, file string) (CommonPage, error) {
+	page, err := r.GetPage(docPath)
+	if err != nil {
+		return page, err
+	}
+
+	if file == "" {
+		file = page.Content.Path
+	}
+
+	if prevFile == "" {
+		prevFile = file
+	}
+
+	if pageKey(file) == "" || pageKey(prevFile) == "" {
+		return page, fmt.Errorf("%s is not a page", file)
+	}
+
+	revision := second
+	if first, err = r.ResolveRevision(first); err != nil {
+		return page, err
+	}
+
+	if second, err = r.ResolveRevision(second); err != nil {
+		return page, err
+	}
+
+	bts, err := r.backend.Show(second, file)
+	if err == ErrGitTimeout {
+		return page, err
+	} else if err != nil {
+		return page, fmt.Errorf("Can't find %s in %s", file, revision)
+	}
+
+	// the page didn't exist in the first revision, everything is inserted
+	var prevBts []byte
+	if first != emptyTree {
+		if prevBts, err = r.backend.Show(first, prevFile); err == ErrGitTimeout {
+			return page, err
+		}
+	}
+
+	changes := &PageChanges{}
+	if changes.To, err = r.getCommitLog(second); err != nil {
+		return page, err
+	}
+
+	if first != emptyTree {
+		if changes.From, err = r.getCommitLog(first); err != nil {
+			return page, err
+		}
+	}
+
+	r.mx.RLock()
+	index := r.index
+	r.mx.RUnlock()
+
+	prev := r.renderContent(prevFile, prevBts, index)
+	content := r.renderContent(file, bts, index)
+	content.Content = proseDiff(string(prev.Content), string(content.Content))
+	content.Path = page.Content.Path
+	content.EditLink = ""
+	page.Content = &content
+	page.Changes = changes
+	page.Backlinks = nil
+
+	return page, nil
+}
+
+// GetBacklinks - return pages which link to the page, false in case of no such page
+func (r *Renderer) GetBacklinks(docPath string) ([]PageRef, bool) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	if _, ok := r.contents[docPath]; !ok {
+		return nil, false
+	}
+
+	return r.backlinks[docPath], true
 }
 
 // Run - run renderer
 func (r *Renderer) Run() {
-	go r.updateWatcher()
+	if r.branch != "" {
+		go r.branchWatcher()
+	} else {
+		go r.updateWatcher()
+	}
 
 	// init data storage
 	r.scanStorage()
 }
 
-func (r *Renderer) scanStorage() {
-	files, err := ioutil.ReadDir(r.path)
+// branchWatcher - cycle for monitoring the branch of a bare repository
+func (r *Renderer) branchWatcher() {
+	for range time.NewTicker(time.Second * 5).C {
+		r.checkBranch()
+	}
+}
+
+// checkBranch - scan the files again and reload pages of the clients if the branch points to another commit
+func (r *Renderer) checkBranch() {
+	commit, err := r.backend.RevParse(r.branch)
 	if err != nil {
-		log.Fatal(err)
+		log.Errorf("Can't resolve the branch %s: %v", r.branch, err)
+		return
 	}
 
-	r.isMainPageExist = false
-	isGitRepo := false
-	commonPage := CommonPage{}
-	for _, f := range files {
-		fmt.Println(f.Name())
-		apath, err := filepath.Abs(filepath.Join(r.path, f.Name()))
-		if err != nil {
+	if commit != r.head() {
+		r.scanStorage()
+		r.message <- true
+	}
+}
+
+// Rescan - scan the storage right away and reload pages of the clients
+func (r *Renderer) Rescan() {
+	r.scanStorage()
+	r.message <- true
+}
+
+func (r *Renderer) scanStorage() {
+	r.scanMx.Lock()
+	defer r.scanMx.Unlock()
+
+	r.mx.RLock()
+	storage, revision := r.storage, r.revision
+	r.mx.RUnlock()
+
+	// files of a bare repository are read from the commit the branch points to now
+	if r.branch != "" {
+		var err error
+		if revision, err = r.backend.RevParse(r.branch); err != nil {
+			log.Errorf("Can't resolve the branch %s: %v", r.branch, err)
+			return
+		}
+
+		if storage, err = newGitStorage(r, revision); err != nil {
 			log.Error(err)
+			return
 		}
+	}
 
-		switch strings.ToLower(f.Name()) {
-		case "home.md", "index.md", "README.md":
-			page, err := r.addContent(apath)
-			if err != nil {
-				log.Error(err)
-			}
+	// the pages of the previous scan are served until the storage can be read again
+	files, err := storage.Files()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	isMainPageExist := false
+	isGitRepo := false
+	commonPage := CommonPage{}
+	contents := make(map[string]*Page)
 
-			r.contents["/"] = &page
-			r.isMainPageExist = true
+	// all pages have to be known before rendering to resolve links between them
+	index := newPageIndex(files)
+	for _, f := range files {
+		switch strings.ToLower(f) {
 		case "_header.md":
-			header, err := r.addContent(apath)
+			header, err := r.addContent(storage, f, index)
 			if err != nil {
 				log.Error(err)
 			}
 
 			commonPage.Header = header
 		case "_footer.md":
-			footer, err := r.addContent(apath)
+			footer, err := r.addContent(storage, f, index)
 			if err != nil {
 				log.Error(err)
 			}
 
 			commonPage.Footer = footer
 		case "_sidebar.md":
-			sidebar, err := r.addContent(apath)
+			sidebar, err := r.addContent(storage, f, index)
 			if err != nil {
 				log.Error(err)
 			}
@@ -234,64 +597,83 @@ func (r *Renderer) scanStorage() {
 		case "custom.js":
 			commonPage.IsCustomJS = true
 		default:
-			if filepath.Ext(f.Name()) == ".md" {
-				page, err := r.addContent(apath)
-				if err != nil {
-					log.Error(err)
-				}
-
-				r.contents[strings.TrimRight(f.Name(), ".md")] = &page
+			key := pageKey(f)
+			if key == "" || index.keys[key] != f {
+				continue
 			}
-		}
 
-		// check if this dir is git repo
-		if f.Name() == ".git" {
-			fi, err := os.Stat(apath)
+			page, err := r.addContent(storage, f, index)
 			if err != nil {
 				log.Error(err)
 				continue
 			}
 
-			// if object with name .git is dir
-			if fi.IsDir() {
-				isGitRepo = true
+			contents[key] = &page
+			if key == "/" {
+				isMainPageExist = true
 			}
 		}
 	}
 
+	// check if this dir is git repo
+	if fi, err := os.Stat(r.gitDir); err == nil && fi.IsDir() {
+		isGitRepo = true
+	}
+
+	var renames []FileRename
+	var stats map[string]*fileStat
+	var tree map[string]bool
 	if isGitRepo {
-		out, err := exec.Command("/usr/bin/git", "--git-dir", filepath.Join(r.path, ".git"), "log").Output()
-		if err != nil {
-			log.Error(err)
+		head := revision
+		if head == "" {
+			head = "HEAD"
 		}
 
-		reAuthor := regexp.MustCompile(`Author: ([^<]*)`)
-		dateAuthor := regexp.MustCompile(`Date: ([^\n]*)`)
-
-		rps := reAuthor.FindAllStringSubmatch(string(out), 1)
-		author := strings.TrimSpace(rps[0][1])
+		// pages are deleted by commits, files removed from the docroot only are not
+		var latest *fileStat
+		var treeFiles []TreeFile
+		commit, err := r.backend.RevParse(head)
+		if err == nil {
+			var history *fileHistory
+			if history, err = r.getHistory(commit); err == nil {
+				renames, stats, latest = history.renames, history.stats, history.latest
+				treeFiles, err = r.backend.Tree(commit)
+			}
+		}
 
-		rps = dateAuthor.FindAllStringSubmatch(string(out), 1)
-		date, err := time.Parse("Mon Jan _2 15:04:05 2006 -0700", strings.TrimSpace(rps[0][1]))
 		if err != nil {
 			log.Error(err)
+		} else {
+			tree = make(map[string]bool, len(treeFiles))
+			for _, f := range treeFiles {
+				tree[f.Path] = true
+			}
+		}
+
+		commonPage.IsGitRepo = true
+		if latest != nil {
+			commonPage.LastModifiedBy = latest.LastModifiedBy
+			commonPage.LastModifiedAt = latest.LastModifiedAt.Format("2006-01-02 15:04:05")
 		}
 
-		commonPage.LastModifiedBy = author
-		commonPage.LastModifiedAt = date.Format("2006-01-02 15:04:05")
+		for _, page := range contents {
+			if stat, ok := stats[page.Path]; ok {
+				page.LastModifiedBy = stat.LastModifiedBy
+				page.LastModifiedAt = stat.LastModifiedAt.Format("2006-01-02 15:04:05")
+				page.Contributors = stat.Contributors()
+			}
+		}
 
-		out, err = exec.Command("/usr/bin/git", "--git-dir", filepath.Join(r.path, ".git"), "remote", "get-url", "origin").Output()
+		editLinkHost, err := r.backend.RemoteURL("origin")
 		if err != nil {
 			log.Error(err)
 		}
 
-		editLinkHost := strings.TrimSpace(string(out))
 		editLinkHost = strings.Replace(editLinkHost, ".git", "", -1)
 		editLinkHost = strings.Replace(editLinkHost, ".wiki", "/wiki", -1)
-		fmt.Println(editLinkHost)
-		for ind, l := range r.contents {
+		for _, l := range contents {
 			if l.EditLink != "" {
-				r.contents[ind].EditLink = editLinkHost + "/" + l.EditLink
+				l.EditLink = editLinkHost + "/" + l.EditLink
 			}
 		}
 
@@ -307,71 +689,403 @@ func (r *Renderer) scanStorage() {
 			commonPage.Footer.EditLink = editLinkHost + "/" + commonPage.Footer.EditLink
 		}
 
-	} else {
-		for _, l := range r.contents {
+	}
+
+	// snapshots at other refs can't be edited
+	if !isGitRepo || (revision != "" && r.branch == "") {
+		for _, l := range contents {
 			l.EditLink = ""
 		}
+
+		commonPage.Sidebar.EditLink = ""
+		commonPage.Header.EditLink = ""
+		commonPage.Footer.EditLink = ""
 	}
 
+	// pages deleted since the last scan are gone, their old urls may still lead to the renamed ones
+	search := newSearchIndex(contents)
+	backlinks := buildBacklinks(contents)
+	brokenLinks := buildBrokenLinks(contents)
+	redirects := buildRedirects(contents, renames)
+	deleted := deletedPages(stats, tree, redirects)
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.storage = storage
+	r.revision = revision
+	r.contents = contents
+	r.index = index
+	r.search = search
+	r.backlinks = backlinks
+	r.redirects = redirects
+	r.brokenLinks = brokenLinks
+	r.deleted = deleted
+	r.isMainPageExist = isMainPageExist
 	r.page = commonPage
 }
 
 // IsMainPageExist - check if main page is exist
 func (r *Renderer) IsMainPageExist() bool {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
 	return r.isMainPageExist
 }
 
-func (r *Renderer) GetPages() map[string]string {
-	result := make(map[string]string)
+// GetPages - return all pages by their url keys
+func (r *Renderer) GetPages() map[string]*Page {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	result := make(map[string]*Page)
 	for key, val := range r.contents {
-		result[key] = val.Title
+		result[key] = val
 	}
 
 	return result
 }
 
-func round(f float64) int {
-	if f < -0.5 {
-		return int(f - 0.5)
+// GetBrokenLinks - return broken links of all pages found during the last scan
+func (r *Renderer) GetBrokenLinks() []BrokenLinks {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	return r.brokenLinks
+}
+
+// Search - full-text search over all pages
+func (r *Renderer) Search(query SearchQuery) []SearchResult {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	if r.search == nil {
+		return nil
+	}
+
+	return r.search.Search(query)
+}
+
+// GetSearchFilters - folders and tags which can be used to narrow the search
+func (r *Renderer) GetSearchFilters() (folders []string, tags []string) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	if r.search == nil {
+		return nil, nil
+	}
+
+	return r.search.Folders(), r.search.Tags()
+}
+
+// emptyTree - hash of the empty tree, used as the previous revision of the first commit
+const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// FileRevision - commit which changed the file
+type FileRevision struct {
+	GitLog
+	Path       string // path of the file in this commit
+	PrevCommit string // previous commit which changed the file, empty tree for the first one
+	PrevPath   string // path of the file in the previous commit
+}
+
+// RevisionError - revision given by the client is not a commit of the repository
+type RevisionError struct {
+	Revision string
+}
+
+func (e RevisionError) Error() string {
+	return fmt.Sprintf("%q is not a revision of the wiki", e.Revision)
+}
+
+// ResolveRevision - full name of the commit, revisions come from urls so anything else is rejected
+// before it reaches git as an option
+func (r *Renderer) ResolveRevision(revision string) (string, error) {
+	if revision == emptyTree {
+		return emptyTree, nil
+	}
+
+	if revision == "" || strings.HasPrefix(revision, "-") {
+		return "", RevisionError{revision}
+	}
+
+	commit, err := r.backend.RevParse(revision)
+	if err == ErrGitTimeout {
+		return "", err
+	}
+
+	if err != nil || !isObjectName(commit) {
+		return "", RevisionError{revision}
+	}
+
+	return commit, nil
+}
+
+// head - commit the wiki is served from, HEAD for the docroot
+func (r *Renderer) head() string {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	if r.revision != "" {
+		return r.revision
+	}
+
+	return "HEAD"
+}
+
+// ReadFile - content of the file relative to the docroot
+func (r *Renderer) ReadFile(path string) ([]byte, error) {
+	r.mx.RLock()
+	storage := r.storage
+	r.mx.RUnlock()
+
+	if storage == nil {
+		return nil, fmt.Errorf("Can't find %s", path)
+	}
+
+	return storage.ReadFile(path)
+}
+
+// FilePath - path of the file on the disk, false if the files are read from git
+func (r *Renderer) FilePath(path string) (string, bool) {
+	r.mx.RLock()
+	storage, ok := r.storage.(fsStorage)
+	r.mx.RUnlock()
+
+	if !ok {
+		return "", false
+	}
+
+	return filepath.Join(storage.root, filepath.FromSlash(path)), true
+}
+
+// HistoryFilter - filters of the commit history, empty ones are not applied
+type HistoryFilter struct {
+	Path   string // file or folder relative to the docroot
+	Author string // author name or email, a regular expression as git log --author takes it
+	Since  string // any date git understands: 2024-01-01, "1 week ago"
+	Until  string
+	Grep   string // regular expression matched against the commit message, case insensitive
+}
+
+// query - log query of the filter up to the head commit
+func (f HistoryFilter) query(head string) LogQuery {
+	query := LogQuery{
+		Revisions: []string{head},
+		Author:    f.Author,
+		Since:     f.Since,
+		Until:     f.Until,
+		Grep:      f.Grep,
+	}
+
+	if path := strings.Trim(f.Path, "/"); path != "" {
+		query.Paths = []string{path}
+	}
+
+	return query
+}
+
+// GetHistory - get commit history matching the filter and the number of pages
+func (r *Renderer) GetHistory(filter HistoryFilter, limit, skip int) ([]GitLog, int, error) {
+	query := filter.query(r.head())
+	count, err := r.backend.Count(query)
+	if err == ErrGitTimeout {
+		return []GitLog{}, 0, err
+	} else if err != nil {
+		// broken regular expressions and dates of the filter are rejected
+		return []GitLog{}, 0, fmt.Errorf("Invalid filter of the history: %v", err)
+	}
+
+	query.MaxCount, query.Skip = limit, skip
+	results, err := r.backend.Log(query)
+	if err != nil {
+		return []GitLog{}, 0, err
+	}
+
+	return results, pagesCount(count, limit), nil
+}
+
+// GetFileHistory - get history of the file relative to the docroot, renames are followed
+func (r *Renderer) GetFileHistory(file string, limit, skip int) ([]FileRevision, int, error) {
+	logs, err := r.backend.Log(LogQuery{Revisions: []string{r.head()}, Paths: []string{file}, Follow: true, Files: true})
+	if err != nil {
+		return []FileRevision{}, 0, err
+	}
+
+	revisions := []FileRevision{}
+	for _, commit := range logs {
+		revision := FileRevision{GitLog: commit, Path: file}
+		if len(commit.Files) > 0 {
+			revision.Path = commit.Files[len(commit.Files)-1]
+		} else if len(revisions) > 0 {
+			// merge commits come without file names
+			revision.Path = revisions[len(revisions)-1].Path
+		}
+
+		revisions = append(revisions, revision)
+	}
+
+	for i := range revisions {
+		revisions[i].PrevCommit = emptyTree
+		revisions[i].PrevPath = revisions[i].Path
+		if i+1 < len(revisions) {
+			revisions[i].PrevCommit = revisions[i+1].Commit
+			revisions[i].PrevPath = revisions[i+1].Path
+		}
+	}
+
+	count := pagesCount(len(revisions), limit)
+	if skip >= len(revisions) {
+		return []FileRevision{}, count, nil
 	}
-	if f > 0.5 {
-		return int(f + 0.5)
+
+	revisions = revisions[skip:]
+	if len(revisions) > limit {
+		revisions = revisions[:limit]
 	}
-	return 0
+
+	return revisions, count, nil
 }
 
-// GetHistory - get commit history
-func (r *Renderer) GetHistory(limit, skip int) ([]GitLog, int) {
-	out, err := exec.Command("/usr/bin/git", "--git-dir", filepath.Join(r.path, ".git"), "rev-list", "--count", "HEAD").Output()
-	count, err := strconv.Atoi(strings.TrimSpace(string(out)))
+// getCommitLog - commit of the resolved revision
+func (r *Renderer) getCommitLog(commit string) (*GitLog, error) {
+	commits, err := r.backend.Log(LogQuery{Revisions: []string{commit}, MaxCount: 1})
+	if err == ErrGitTimeout {
+		return nil, err
+	} else if err != nil || len(commits) == 0 {
+		return nil, fmt.Errorf("Can't find the revision %s", commit)
+	}
 
-	out, err = exec.Command("/usr/bin/git", "--git-dir", filepath.Join(r.path, ".git"), "log", "--max-count", strconv.Itoa(limit), "--skip", strconv.Itoa(skip), `--pretty=format:{%n  "commit": "%H",%n  "abbreviated_commit": "%h",%n  "tree": "%T",%n  "abbreviated_tree": "%t",%n  "parent": "%P",%n  "abbreviated_parent": "%p",%n  "refs": "%D",%n  "encoding": "%e",%n  "subject": "%s",%n  "sanitized_subject_line": "%f",%n  "body": "%b",%n  "commit_notes": "%N",%n  "verification_flag": "%G?",%n  "signer": "%GS",%n  "signer_key": "%GK",%n  "author": {%n    "name": "%aN",%n    "email": "%aE",%n    "date": "%aI"%n  },%n  "commiter": {%n    "name": "%cN",%n    "email": "%cE",%n    "date": "%cI"%n  }%n}%n`).Output()
+	return &commits[0], nil
+}
+
+// GetCommit - get the commit with the list of changed files, markdown files come with diffs
+func (r *Renderer) GetCommit(revision string) (*GitLog, []ChangedFile, error) {
+	sha, err := r.ResolveRevision(revision)
 	if err != nil {
-		log.Error(err)
+		return nil, nil, err
 	}
 
-	results := []GitLog{}
-	obj := GitLog{}
-	data := bytes.NewReader(out)
-	decoder := json.NewDecoder(data)
-	for {
-		if err := decoder.Decode(&obj); err == io.EOF {
-			break
-		} else if err != nil {
-			log.Fatal(err)
+	commit, err := r.getCommitLog(sha)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// changes are shown against the first parent, the first commit is compared with nothing
+	parent := emptyTree
+	if parents := strings.Fields(commit.Parent); len(parents) > 0 {
+		parent = parents[0]
+	}
+
+	diffs, err := r.backend.Diff(parent, commit.Commit)
+	if err != nil {
+		return commit, nil, err
+	}
+
+	r.highlightCode(diffs)
+
+	r.mx.RLock()
+	index := r.index
+	r.mx.RUnlock()
+
+	files := []ChangedFile{}
+	for i, diff := range diffs {
+		file := ChangedFile{Status: diff.Status, Path: diff.Path(), OldPath: diff.OldPath}
+		if file.OldPath == "" {
+			file.OldPath = file.Path
 		}
 
-		results = append(results, obj)
+		isPage := pageKey(file.Path) != ""
+		if isPage || isImageFile(file.Path) {
+			file.Diff = &diffs[i]
+		}
+
+		if isPage && file.Status != "D" {
+			if key, ok := index.resolve("", "/"+file.Path); ok {
+				file.PageURL = pageActionURL(key, "_rev", commit.Commit) + "?path=" + url.QueryEscape(file.Path)
+			}
+		}
+
+		files = append(files, file)
+	}
+
+	return commit, files, nil
+}
+
+// GetBlame - get the author of every line of the file relative to the docroot
+func (r *Renderer) GetBlame(file string) ([]BlameBlock, error) {
+	return r.backend.Blame(r.head(), file)
+}
+
+// pagesCount - number of pages needed to show all items
+func pagesCount(count, limit int) int {
+	if limit <= 0 {
+		return 0
+	}
+
+	return (count + limit - 1) / limit
+}
+
+// GetFileDiffs - get parsed diff between two revisions, limited to the paths if any
+func (r *Renderer) GetFileDiffs(first, second string, paths ...string) ([]FileDiff, error) {
+	diffs, err := r.backend.Diff(first, second, paths...)
+	if err != nil {
+		return nil, err
 	}
 
-	return results, round(float64(count) / float64(limit))
+	r.highlightCode(diffs)
+	return diffs, nil
 }
 
-func (r *Renderer) GetDiff(first, second string) string {
-	out, err := exec.Command("/usr/bin/git", "--git-dir", filepath.Join(r.path, ".git"), "diff", first, second).Output()
+// highlightCode - highlight fenced code in the diffs of pages, both versions of the page tell which lines
+// are code, the hunks alone may start in the middle of a block
+func (r *Renderer) highlightCode(diffs []FileDiff) {
+	for i := range diffs {
+		diff := &diffs[i]
+		if diff.Binary || len(diff.Hunks) == 0 || pageKey(diff.Path()) == "" {
+			continue
+		}
+
+		oldLanguages, newLanguages := r.blobLanguages(diff.OldBlob), r.blobLanguages(diff.NewBlob)
+		language := func(line DiffLine) string {
+			languages, number := oldLanguages, line.OldNumber
+			if line.Kind == "add" {
+				languages, number = newLanguages, line.NewNumber
+			}
+
+			if number < 1 || number > len(languages) {
+				return ""
+			}
+
+			return languages[number-1]
+		}
+
+		for j := range diff.Hunks {
+			highlightChanges(diff.Hunks[j].Lines, language)
+		}
+	}
+}
+
+// blobLanguages - languages of the lines of the markdown file, nothing is highlighted if it can't be read
+func (r *Renderer) blobLanguages(blob string) []string {
+	if blob == "" {
+		return nil
+	}
+
+	bts, err := r.backend.Show(blob, "")
 	if err != nil {
 		log.Error(err)
+		return nil
+	}
+
+	return codeLanguages(string(bts))
+}
+
+// GetBlob - content of the git object
+func (r *Renderer) GetBlob(blob string) ([]byte, error) {
+	if !isObjectName(blob) {
+		return nil, fmt.Errorf("%s is not an object name", blob)
 	}
 
-	return string(out)
+	return r.backend.Show(blob, "")
 }
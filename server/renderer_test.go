@@ -0,0 +1,496 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeDocroot - temporary docroot with the files, paths are relative to the docroot
+func writeDocroot(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "rowi-docroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for file, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+// fixtureRepo - repository with renames, a binary file, a merge, tags, packed and loose objects
+func fixtureRepo(t *testing.T) string {
+	if _, err := exec.LookPath(gitBinary); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "rowi-fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	day := 0
+	git := func(args ...string) {
+		cmd := exec.Command(gitBinary, append([]string{"-c", "init.defaultBranch=master"}, args...)...)
+		cmd.Dir = dir
+		date := fmt.Sprintf("2024-01-%02dT10:00:00+02:00", day+1)
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date,
+			"GIT_AUTHOR_NAME=Ann", "GIT_AUTHOR_EMAIL=ann@example.com", "GIT_COMMITTER_NAME=Ann",
+			"GIT_COMMITTER_EMAIL=ann@example.com", "GIT_CONFIG_NOSYSTEM=1",
+			"HOME="+dir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	write := func(file, content string) {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	commit := func(author, message string) {
+		git("add", "-A")
+		git("commit", "-q", "--author", author+" <"+strings.ToLower(author)+"@example.com>", "-m", message)
+		day++
+	}
+
+	notes := "# Notes\n\nfirst\nsecond\nthird\nfourth\nfifth\nsixth\nseventh\neighth\nninth\ntenth\n"
+	git("init", "-q")
+	git("remote", "add", "origin", "https://github.com/example/wiki.wiki.git")
+	write("Home.md", "# Home\n\nWelcome\n")
+	write("notes.md", notes)
+	write("logo.png", "\x89PNG\r\n\x1a\n\x00\x00binary")
+	commit("Ann", "Add home, notes and logo")
+
+	write("notes.md", strings.Replace(notes, "third", "third changed", 1))
+	write("runbooks/db.md", "# DB\n\nfailover\n")
+	commit("Bob", "Edit notes... and add the db runbook")
+
+	git("mv", "notes.md", "runbooks/notes.md")
+	write("runbooks/notes.md", strings.Replace(notes, "third", "third changed", 1)+"eleventh\n")
+	commit("Ann", "Move notes into the \"runbooks\" folder\n\nKeeps C:\\wiki\\notes paths and {\"json\": true} intact.\n")
+	git("tag", "-a", "-m", "First release", "v1")
+
+	git("checkout", "-q", "-b", "feature")
+	write("Home.md", "# Home\n\nWelcome to the wiki\n")
+	commit("Carl", "Edit home")
+
+	git("checkout", "-q", "master")
+	write("runbooks/db.md", "# DB\n\nfailover\nrestore")
+	write("logo.png", "\x89PNG\r\n\x1a\n\x00\x00binary, changed")
+	commit("Bob", "Edit db runbook")
+
+	git("merge", "-q", "--no-ff", "-m", "Merge feature", "feature")
+	day++
+	git("tag", "v2")
+	git("gc", "-q")
+
+	write("Home.md", "# Home\n\nWelcome to the wiki\n\nSee [[Notes]]\n")
+	write("drafts.md", "# Drafts\n\nIdeas for the [[Notes]]\n")
+	commit("Ann", "Link notes from home")
+
+	git("mv", "runbooks/db.md", "runbooks/database.md")
+	git("mv", "Home.md", "Start.md")
+	commit("Bob", "Rename the db runbook and the home page")
+
+	git("rm", "-q", "drafts.md")
+	commit("Carl", "Drop the drafts")
+
+	return filepath.Join(dir, ".git")
+}
+
+func TestHistoryFilterQuery(t *testing.T) {
+	args := logArgs(HistoryFilter{}.query("HEAD"))
+	if !reflect.DeepEqual(args, []string{"--end-of-options", "HEAD", "--"}) {
+		t.Errorf("unexpected args of the empty filter: %q", args)
+	}
+
+	args = logArgs(HistoryFilter{
+		Path:   "/runbooks/",
+		Author: "sre@example.com",
+		Since:  "1 week ago",
+		Grep:   "--output=/tmp/x",
+	}.query("HEAD"))
+	expected := []string{
+		"--author=sre@example.com",
+		"--since=1 week ago",
+		"--grep=--output=/tmp/x",
+		"--regexp-ignore-case",
+		"--end-of-options",
+		"HEAD",
+		"--",
+		"runbooks",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %q, got %q", expected, args)
+	}
+}
+
+func TestScanStorageEvictsDeletedPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rowi-docroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"Home.md", "notes.md"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte("# "+file+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewRenderer(dir, make(chan interface{}, 1))
+	r.scanStorage()
+	if _, err := r.GetPage("notes"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "notes.md")); err != nil {
+		t.Fatal(err)
+	}
+
+	r.scanStorage()
+	if _, err := r.GetPage("notes"); err == nil {
+		t.Error("deleted page is still served")
+	}
+
+	if results := r.Search(SearchQuery{Terms: []string{"notes"}}); len(results) != 0 {
+		t.Errorf("deleted page is still found: %+v", results)
+	}
+}
+
+func TestScanStorageRecursive(t *testing.T) {
+	dir := writeDocroot(t, map[string]string{
+		"Home.md":                 "# Home\n\n[Failover](runbooks/db/failover.md)\n",
+		"runbooks/index.md":       "# Runbooks\n",
+		"runbooks/db/failover.md": "# Failover\n\n[Back](../index.md)\n",
+		"runbooks/_partial.md":    "# Partial\n",
+		".github/notes.md":        "# Hidden\n",
+		"design/diagram.png":      "\x89PNG",
+	})
+
+	r := NewRenderer(dir, make(chan interface{}, 1))
+	r.scanStorage()
+
+	keys := map[string]string{}
+	for key := range r.GetPages() {
+		page, err := r.GetPage(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys[key] = page.Content.Path
+	}
+
+	expected := map[string]string{
+		"/":                    "Home.md",
+		"runbooks":             "runbooks/index.md",
+		"runbooks/db/failover": "runbooks/db/failover.md",
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected pages %v, got %v", expected, keys)
+	}
+
+	page, err := r.GetPage("runbooks/db/failover")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if page.Content.Title != "Failover" || !strings.Contains(string(page.Content.Content), `<a href="/runbooks"`) {
+		t.Errorf("unexpected page: %+v", page.Content)
+	}
+
+	if !r.IsMainPageExist() {
+		t.Error("main page is not found")
+	}
+}
+
+func TestScanStorageKeepsPages(t *testing.T) {
+	dir := writeDocroot(t, map[string]string{"Home.md": "# Home\n"})
+	r := NewRenderer(dir, make(chan interface{}, 1))
+	r.scanStorage()
+
+	// the docroot can't be read, the pages of the previous scan are served
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	r.scanStorage()
+	if _, err := r.GetPage("/"); err != nil {
+		t.Errorf("expected the previous pages to be kept: %v", err)
+	}
+}
+
+func TestBareRenderer(t *testing.T) {
+	gitDir := fixtureRepo(t)
+	bare := filepath.Join(writeDocroot(t, nil), "wiki.git")
+	if out, err := exec.Command(gitBinary, "clone", "-q", "--bare", gitDir, bare).CombinedOutput(); err != nil {
+		t.Fatalf("git clone: %v\n%s", err, out)
+	}
+
+	message := make(chan interface{}, 1)
+	r := NewBareRenderer(bare, "master", message)
+	r.scanStorage()
+
+	pages := []string{}
+	for key := range r.GetPages() {
+		pages = append(pages, key)
+	}
+
+	sort.Strings(pages)
+	expected := []string{"Start", "runbooks/database", "runbooks/notes"}
+	if !reflect.DeepEqual(pages, expected) {
+		t.Errorf("expected pages %q, got %q", expected, pages)
+	}
+
+	page, err := r.GetPage("runbooks/notes")
+	if err != nil || !strings.Contains(string(page.Content.Content), "eleventh") {
+		t.Errorf("unexpected page: %+v, %v", page.Content, err)
+	}
+
+	if logo, err := r.ReadFile("logo.png"); string(logo) != "\x89PNG\r\n\x1a\n\x00\x00binary, changed" || err != nil {
+		t.Errorf("unexpected attachment: %q, %v", logo, err)
+	}
+
+	r.checkBranch()
+	if len(message) != 0 {
+		t.Error("expected no reload while the branch stays at the same commit")
+	}
+
+	// the branch is moved back to the first release
+	if out, err := exec.Command(gitBinary, "--git-dir", bare, "update-ref", "refs/heads/master", "v1^{commit}").CombinedOutput(); err != nil {
+		t.Fatalf("git update-ref: %v\n%s", err, out)
+	}
+
+	r.checkBranch()
+	if len(message) != 1 {
+		t.Error("expected the clients to be reloaded")
+	}
+
+	if _, err := r.GetPage("runbooks/db"); err != nil {
+		t.Errorf("expected the page of the first release: %v", err)
+	}
+
+	if logo, err := r.ReadFile("logo.png"); string(logo) != "\x89PNG\r\n\x1a\n\x00\x00binary" || err != nil {
+		t.Errorf("unexpected attachment of the first release: %q, %v", logo, err)
+	}
+}
+
+func TestRenderContentImages(t *testing.T) {
+	index := newPageIndex([]string{"Home.md", "logo.png", "runbooks/Home.md", "runbooks/diagram one.png"})
+	r := NewRenderer("", make(chan interface{}, 1))
+	source := "# Runbooks\n\n![diagram](diagram%20one.png) ![logo](../logo.png) ![badge](https://example.com/badge.svg) " +
+		"![missing](missing.png)\n"
+	page := r.renderContent("runbooks/Home.md", []byte(source), index)
+
+	for _, img := range []string{
+		`<img src="/runbooks/diagram%20one.png"`,
+		`<img src="/logo.png"`,
+		`<img src="https://example.com/badge.svg"`,
+		`<img src="/runbooks/missing.png"`,
+	} {
+		if !strings.Contains(string(page.Content), img) {
+			t.Errorf("expected %s in %s", img, page.Content)
+		}
+	}
+
+	expected := []PageLink{
+		{Key: "runbooks/diagram one.png", IsFound: true, IsAttachment: true},
+		{Key: "logo.png", IsFound: true, IsAttachment: true},
+		{Key: "runbooks/missing.png", IsAttachment: true},
+	}
+	if !reflect.DeepEqual(page.Links, expected) {
+		t.Errorf("expected links %+v, got %+v", expected, page.Links)
+	}
+}
+
+func TestGetFileHistory(t *testing.T) {
+	r := NewRenderer(filepath.Dir(fixtureRepo(t)), make(chan interface{}, 1))
+	r.scanStorage()
+
+	revisions, count, err := r.GetFileHistory("runbooks/notes.md", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary := []string{}
+	for i, revision := range revisions {
+		prev := revision.PrevCommit
+		if i+1 < len(revisions) && prev == revisions[i+1].Commit {
+			prev = "next"
+		}
+
+		summary = append(summary, revision.Subject+" "+revision.Path+" "+prev+" "+revision.PrevPath)
+	}
+
+	expected := []string{
+		`Move notes into the "runbooks" folder runbooks/notes.md next notes.md`,
+		"Edit notes... and add the db runbook notes.md next notes.md",
+		"Add home, notes and logo notes.md " + emptyTree + " notes.md",
+	}
+	if count != 1 || !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("expected %q, got %q, %d pages", expected, summary, count)
+	}
+
+	paged, count, err := r.GetFileHistory("runbooks/notes.md", 2, 2)
+	if err != nil || count != 2 || len(paged) != 1 || paged[0].Commit != revisions[2].Commit {
+		t.Errorf("unexpected second page: %+v, %d, %v", paged, count, err)
+	}
+
+	// the diff of the rename is limited to both paths of the page
+	move := revisions[0]
+	diffs, err := r.GetFileDiffs(move.PrevCommit, move.Commit, move.PrevPath, move.Path)
+	if err != nil || len(diffs) != 1 {
+		t.Fatalf("unexpected diff of the move: %+v, %v", diffs, err)
+	}
+
+	if diffs[0].Status != "R" || diffs[0].OldPath != "notes.md" || diffs[0].NewPath != "runbooks/notes.md" {
+		t.Errorf("unexpected diff of the move: %+v", diffs[0])
+	}
+
+	first := revisions[2]
+	diffs, err = r.GetFileDiffs(first.PrevCommit, first.Commit, first.Path)
+	if err != nil || len(diffs) != 1 || diffs[0].Status != "A" || diffs[0].NewPath != "notes.md" {
+		t.Errorf("unexpected diff of the first revision: %+v, %v", diffs, err)
+	}
+}
+
+func TestGetPageRevision(t *testing.T) {
+	r := NewRenderer(filepath.Dir(fixtureRepo(t)), make(chan interface{}, 1))
+	r.scanStorage()
+
+	page, err := r.GetPageRevision("runbooks/notes", "v1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := string(page.Content.Content)
+	if !strings.Contains(content, "third changed") || !strings.Contains(content, "eleventh") {
+		t.Errorf("unexpected content of the revision: %s", content)
+	}
+
+	if page.Revision == nil || page.Revision.Subject != `Move notes into the "runbooks" folder` {
+		t.Errorf("unexpected revision: %+v", page.Revision)
+	}
+
+	if page.Content.Path != "runbooks/notes.md" || page.Content.EditLink != "" || page.Backlinks != nil {
+		t.Errorf("unexpected page of the revision: %+v, %+v", page.Content, page.Backlinks)
+	}
+
+	// the page had another path before it was moved
+	page, err = r.GetPageRevision("runbooks/notes", "v1~1", "notes.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content = string(page.Content.Content)
+	if !strings.Contains(content, "third changed") || strings.Contains(content, "eleventh") {
+		t.Errorf("unexpected content before the move: %s", content)
+	}
+
+	if page.Content.Path != "runbooks/notes.md" || page.Revision.Subject != "Edit notes... and add the db runbook" {
+		t.Errorf("unexpected page before the move: %+v, %+v", page.Content, page.Revision)
+	}
+
+	if _, err := r.GetPageRevision("runbooks/notes", "v1~1", ""); err == nil {
+		t.Error("expected an error for the path missing in the revision")
+	}
+
+	if _, err := r.GetPageRevision("runbooks/notes", "v1", "logo.png"); err == nil {
+		t.Error("expected an error for a file which is not a page")
+	}
+
+	if _, err := r.GetPageRevision("runbooks/notes", "--output=x", ""); err != (RevisionError{"--output=x"}) {
+		t.Errorf("expected the revision to be rejected, got %v", err)
+	}
+
+	if _, err := r.GetPageRevision("runbooks/missing", "v1", ""); err == nil {
+		t.Error("expected an error for a missing page")
+	}
+}
+
+func TestGetCommit(t *testing.T) {
+	r := NewRenderer(filepath.Dir(fixtureRepo(t)), make(chan interface{}, 1))
+	r.scanStorage()
+
+	tests := []struct {
+		revision string
+		subject  string
+		files    []string
+	}{
+		{"HEAD", "Drop the drafts", []string{"D drafts.md drafts.md diff "}},
+		{"HEAD~1", "Rename the db runbook and the home page", []string{
+			"R Home.md Start.md diff /Start/_rev/<sha>?path=Start.md",
+			"R runbooks/db.md runbooks/database.md diff /runbooks/database/_rev/<sha>?path=runbooks%2Fdatabase.md",
+		}},
+		{"v1", `Move notes into the "runbooks" folder`, []string{
+			"R notes.md runbooks/notes.md diff /runbooks/notes/_rev/<sha>?path=runbooks%2Fnotes.md",
+		}},
+		// the first commit is compared with the empty tree, moved pages are found by their names
+		{"v1~2", "Add home, notes and logo", []string{
+			"A Home.md Home.md diff ",
+			"A logo.png logo.png diff ",
+			"A notes.md notes.md diff /runbooks/notes/_rev/<sha>?path=notes.md",
+		}},
+	}
+
+	for _, test := range tests {
+		commit, files, err := r.GetCommit(test.revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if commit.Subject != test.subject {
+			t.Errorf("%s: unexpected commit %+v", test.revision, commit)
+		}
+
+		summary := []string{}
+		for _, file := range files {
+			diff := "nodiff"
+			if file.Diff != nil {
+				diff = "diff"
+			}
+
+			pageURL := strings.Replace(file.PageURL, commit.Commit, "<sha>", 1)
+			summary = append(summary, strings.Join([]string{file.Status, file.OldPath, file.Path, diff, pageURL}, " "))
+		}
+
+		if !reflect.DeepEqual(summary, test.files) {
+			t.Errorf("%s: expected %q, got %q", test.revision, test.files, summary)
+		}
+	}
+
+	if _, _, err := r.GetCommit("--output=x"); err != (RevisionError{"--output=x"}) {
+		t.Errorf("expected the revision to be rejected, got %v", err)
+	}
+
+	if _, _, err := r.GetCommit("missing"); err == nil {
+		t.Error("expected an error for a missing revision")
+	}
+}
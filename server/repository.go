@@ -0,0 +1,546 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxSymrefDepth - symbolic refs pointing to each other further are broken
+const maxSymrefDepth = 5
+
+// refRules - where a short ref name is looked for, the first match wins as in git rev-parse
+var refRules = []string{"%s", "refs/%s", "refs/tags/%s", "refs/heads/%s", "refs/remotes/%s", "refs/remotes/%s/HEAD"}
+
+// hexPrefixRe - abbreviated object name
+var hexPrefixRe = regexp.MustCompile(`^[0-9a-f]{4,40}$`)
+
+// supportedExtensions - repository extensions which don't change the way objects and refs are stored
+var supportedExtensions = map[string]bool{
+	"noop":            true,
+	"preciousobjects": true,
+	"worktreeconfig":  true,
+}
+
+// gitRepository - repository read straight from the disk
+type gitRepository struct {
+	dir       string // git directory, HEAD of the worktree is here
+	commonDir string // refs, objects and config, the same as dir unless it's a linked worktree
+	objects   *objectStore
+}
+
+// openGitRepository - open the git directory, repositories with extensions which change their format like
+// sha256 object names or reftable are not supported
+func openGitRepository(dir string) (*gitRepository, error) {
+	// .git of submodules and worktrees is a file: "gitdir: <path>"
+	if fi, err := os.Stat(dir); err == nil && !fi.IsDir() {
+		bts, err := ioutil.ReadFile(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		target := strings.TrimSpace(strings.TrimPrefix(string(bts), "gitdir:"))
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(dir), target)
+		}
+
+		dir = target
+	}
+
+	repo := &gitRepository{dir: dir, commonDir: dir}
+	if bts, err := ioutil.ReadFile(filepath.Join(dir, "commondir")); err == nil {
+		common := strings.TrimSpace(string(bts))
+		if !filepath.IsAbs(common) {
+			common = filepath.Join(dir, common)
+		}
+
+		repo.commonDir = common
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil {
+		return nil, fmt.Errorf("%s is not a git repository", dir)
+	}
+
+	config, err := repo.config()
+	if err != nil {
+		return nil, err
+	}
+
+	if version := config["core.repositoryformatversion"]; version != "" && version != "0" && version != "1" {
+		return nil, fmt.Errorf("Unsupported repository format version %s", version)
+	}
+
+	for key := range config {
+		if strings.HasPrefix(key, "extensions.") && !supportedExtensions[strings.TrimPrefix(key, "extensions.")] {
+			return nil, fmt.Errorf("Unsupported repository extension %s", key)
+		}
+	}
+
+	if repo.objects, err = newObjectStore(filepath.Join(repo.commonDir, "objects")); err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// config - values of the repository config: core.bare, remote.origin.url, the last value wins
+func (r *gitRepository) config() (map[string]string, error) {
+	config := make(map[string]string)
+	f, err := os.Open(filepath.Join(r.commonDir, "config"))
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		// [section] or [section "subsection"], names of sections and keys are case insensitive
+		if line[0] == '[' {
+			end := strings.LastIndexByte(line, ']')
+			if end < 0 {
+				continue
+			}
+
+			header := line[1:end]
+			if quote := strings.IndexByte(header, '"'); quote >= 0 {
+				sub, _ := strconv.Unquote(strings.TrimSpace(header[quote:]))
+				section = strings.ToLower(strings.TrimSpace(header[:quote])) + "." + sub
+			} else {
+				section = strings.ToLower(header)
+			}
+
+			line = strings.TrimSpace(line[end+1:])
+			if line == "" {
+				continue
+			}
+		}
+
+		key, value := line, "true"
+		if eq := strings.IndexByte(line, '='); eq >= 0 {
+			key, value = strings.TrimSpace(line[:eq]), configValue(line[eq+1:])
+		}
+
+		config[section+"."+strings.ToLower(key)] = value
+	}
+
+	return config, scanner.Err()
+}
+
+// configValue - value without comments and quotes
+func configValue(value string) string {
+	var out strings.Builder
+	quoted := false
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && i+1 < len(value):
+			i++
+			switch value[i] {
+			case 'n':
+				out.WriteByte('\n')
+			case 't':
+				out.WriteByte('\t')
+			default:
+				out.WriteByte(value[i])
+			}
+		case (c == '#' || c == ';') && !quoted:
+			return strings.TrimSpace(out.String())
+		default:
+			out.WriteByte(c)
+		}
+	}
+
+	return strings.TrimSpace(out.String())
+}
+
+// refDir - HEAD and other per worktree refs live in the git directory, the rest is shared
+func (r *gitRepository) refDir(name string) string {
+	if !strings.HasPrefix(name, "refs/") || strings.HasPrefix(name, "refs/bisect/") || strings.HasPrefix(name, "refs/worktree/") {
+		return r.dir
+	}
+
+	return r.commonDir
+}
+
+// ref - object the ref points to, symbolic refs are followed, false if there is no such ref
+func (r *gitRepository) ref(name string) (string, bool) {
+	for depth := 0; depth < maxSymrefDepth; depth++ {
+		if !validRefName(name) {
+			return "", false
+		}
+
+		bts, err := ioutil.ReadFile(filepath.Join(r.refDir(name), filepath.FromSlash(name)))
+		if err != nil {
+			packed, ok := r.packedRefs()[name]
+			return packed, ok
+		}
+
+		value := strings.TrimSpace(string(bts))
+		if strings.HasPrefix(value, "ref: ") {
+			name = strings.TrimPrefix(value, "ref: ")
+			continue
+		}
+
+		return value, isObjectName(value)
+	}
+
+	return "", false
+}
+
+// symbolicRef - ref the symbolic ref like HEAD points to, empty for detached HEAD
+func (r *gitRepository) symbolicRef(name string) string {
+	bts, err := ioutil.ReadFile(filepath.Join(r.refDir(name), filepath.FromSlash(name)))
+	if err != nil {
+		return ""
+	}
+
+	value := strings.TrimSpace(string(bts))
+	if !strings.HasPrefix(value, "ref: ") {
+		return ""
+	}
+
+	return strings.TrimPrefix(value, "ref: ")
+}
+
+// packedRefs - refs of the packed-refs file, peeled lines "^<object>" are skipped
+func (r *gitRepository) packedRefs() map[string]string {
+	refs := make(map[string]string)
+	bts, err := ioutil.ReadFile(filepath.Join(r.commonDir, "packed-refs"))
+	if err != nil {
+		return refs
+	}
+
+	for _, line := range strings.Split(string(bts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && isObjectName(fields[0]) {
+			refs[fields[1]] = fields[0]
+		}
+	}
+
+	return refs
+}
+
+// refs - all refs under refs/, loose ones override packed
+func (r *gitRepository) refs() map[string]string {
+	refs := r.packedRefs()
+	root := filepath.Join(r.commonDir, "refs")
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(r.commonDir, path)
+		if err != nil {
+			return nil
+		}
+
+		name := filepath.ToSlash(rel)
+		if object, ok := r.ref(name); ok {
+			refs[name] = object
+		}
+
+		return nil
+	})
+
+	return refs
+}
+
+// validRefName - the name can't leave the git directory or contain characters git forbids
+func validRefName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") || strings.HasSuffix(name, ".lock") ||
+		strings.Contains(name, "..") || strings.Contains(name, "//") || strings.Contains(name, "@{") {
+		return false
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// resolve - object the revision points to: a full or abbreviated object name, a ref and suffixes like
+// ~2, ^2, ^{commit} or ^{}
+func (r *gitRepository) resolve(revision string) (string, error) {
+	base := revision
+	if i := strings.IndexAny(revision, "~^"); i >= 0 {
+		base = revision[:i]
+	}
+
+	object, err := r.resolveName(base)
+	if err != nil {
+		return "", err
+	}
+
+	for rest := revision[len(base):]; rest != ""; {
+		switch {
+		case strings.HasPrefix(rest, "^{"):
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				return "", fmt.Errorf("Invalid revision %s", revision)
+			}
+
+			if object, err = r.peel(object, rest[2:end]); err != nil {
+				return "", err
+			}
+
+			rest = rest[end+1:]
+		case rest[0] == '^' || rest[0] == '~':
+			op := rest[0]
+			digits := 0
+			for digits+1 < len(rest) && rest[digits+1] >= '0' && rest[digits+1] <= '9' {
+				digits++
+			}
+
+			n := 1
+			if digits > 0 {
+				if n, err = strconv.Atoi(rest[1 : digits+1]); err != nil {
+					return "", fmt.Errorf("Invalid revision %s", revision)
+				}
+			}
+
+			rest = rest[digits+1:]
+			if object, err = r.peel(object, "commit"); err != nil {
+				return "", err
+			}
+
+			if op == '^' {
+				object, err = r.parent(object, n)
+			} else {
+				for i := 0; i < n && err == nil; i++ {
+					object, err = r.parent(object, 1)
+				}
+			}
+
+			if err != nil {
+				return "", fmt.Errorf("Can't find %s: %v", revision, err)
+			}
+		default:
+			return "", fmt.Errorf("Invalid revision %s", revision)
+		}
+	}
+
+	return object, nil
+}
+
+// resolveName - object of the full or abbreviated name or the ref
+func (r *gitRepository) resolveName(name string) (string, error) {
+	if name == "@" {
+		name = "HEAD"
+	}
+
+	if isObjectName(name) {
+		if !r.objects.has(name) {
+			return "", fmt.Errorf("Can't find the object %s", name)
+		}
+
+		return name, nil
+	}
+
+	for i, rule := range refRules {
+		// only HEAD, FETCH_HEAD and the like are taken as they are, other files of the git directory aren't refs
+		if i == 0 && !strings.HasPrefix(name, "refs/") && strings.ToUpper(name) != name {
+			continue
+		}
+
+		if object, ok := r.ref(fmt.Sprintf(rule, name)); ok {
+			return object, nil
+		}
+	}
+
+	if hexPrefixRe.MatchString(name) {
+		switch names := r.objects.expand(name); len(names) {
+		case 0:
+		case 1:
+			return names[0], nil
+		default:
+			return "", fmt.Errorf("Short object name %s is ambiguous", name)
+		}
+	}
+
+	return "", fmt.Errorf("Unknown revision %s", name)
+}
+
+// peel - follow annotated tags and commits down to the object of the type, tags are peeled to any other
+// object if the type is empty
+func (r *gitRepository) peel(object, kind string) (string, error) {
+	for depth := 0; ; depth++ {
+		obj, err := r.objects.read(object)
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case kind == "object" || objectTypeName(obj.kind) == kind || (kind == "" && obj.kind != objectTag):
+			return object, nil
+		case obj.kind == objectTag && depth < maxSymrefDepth:
+			object, _ = parseTag(obj.data)
+		case obj.kind == objectCommit && kind == "tree":
+			commit, err := parseCommit(object, obj.data)
+			if err != nil {
+				return "", err
+			}
+
+			return commit.Tree, nil
+		default:
+			return "", fmt.Errorf("%s is not a %s", object, kind)
+		}
+	}
+}
+
+// parent - n-th parent of the commit, the commit itself for 0
+func (r *gitRepository) parent(object string, n int) (string, error) {
+	commit, err := r.commit(object)
+	if err != nil {
+		return "", err
+	}
+
+	if n == 0 {
+		return object, nil
+	}
+
+	if n > len(commit.Parents) {
+		return "", fmt.Errorf("%s has no parent %d", object, n)
+	}
+
+	return commit.Parents[n-1], nil
+}
+
+// commit - parsed commit object
+func (r *gitRepository) commit(name string) (*gitCommit, error) {
+	data, err := r.objects.readType(name, objectCommit)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCommit(name, data)
+}
+
+// tree - entries of the tree, empty for the empty tree even if the repository doesn't have it
+func (r *gitRepository) tree(name string) ([]gitTreeEntry, error) {
+	if name == emptyTree {
+		return []gitTreeEntry{}, nil
+	}
+
+	data, err := r.objects.readType(name, objectTree)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTree(data)
+}
+
+// entry - file or folder of the tree at the path, false if there is no such path
+func (r *gitRepository) entry(tree, path string) (gitTreeEntry, bool) {
+	entry := gitTreeEntry{Mode: modeTree, Hash: tree}
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+
+		if !entry.IsTree() {
+			return gitTreeEntry{}, false
+		}
+
+		entries, err := r.tree(entry.Hash)
+		if err != nil {
+			return gitTreeEntry{}, false
+		}
+
+		i := sort.Search(len(entries), func(i int) bool { return treeEntryKey(entries[i]) >= name })
+		found := false
+		for ; i < len(entries) && strings.HasPrefix(entries[i].Name, name); i++ {
+			if entries[i].Name == name {
+				entry, found = entries[i], true
+				break
+			}
+		}
+
+		if !found {
+			return gitTreeEntry{}, false
+		}
+	}
+
+	return entry, true
+}
+
+// treeEntryKey - entries of trees are sorted as if folders had a trailing slash
+func treeEntryKey(entry gitTreeEntry) string {
+	if entry.IsTree() {
+		return entry.Name + "/"
+	}
+
+	return entry.Name
+}
+
+// decorations - names of the refs pointing to every commit as git log --format=%D shows them
+func (r *gitRepository) decorations() map[string][]string {
+	refs := r.refs()
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+
+	// git lists them from the last ref name to the first one
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	head, _ := r.ref("HEAD")
+	current := r.symbolicRef("HEAD")
+	decorations := make(map[string][]string)
+	if head != "" {
+		if current != "" && strings.HasPrefix(current, "refs/heads/") {
+			decorations[head] = []string{"HEAD -> " + strings.TrimPrefix(current, "refs/heads/")}
+		} else {
+			decorations[head] = []string{"HEAD"}
+		}
+	}
+
+	for _, name := range names {
+		label := ""
+		switch {
+		case name == current:
+			continue
+		case strings.HasPrefix(name, "refs/heads/"):
+			label = strings.TrimPrefix(name, "refs/heads/")
+		case strings.HasPrefix(name, "refs/remotes/"):
+			label = strings.TrimPrefix(name, "refs/remotes/")
+		case strings.HasPrefix(name, "refs/tags/"):
+			label = "tag: " + strings.TrimPrefix(name, "refs/tags/")
+		default:
+			continue
+		}
+
+		commit, err := r.peel(refs[name], "commit")
+		if err != nil {
+			continue
+		}
+
+		decorations[commit] = append(decorations[commit], label)
+	}
+
+	return decorations
+}
@@ -0,0 +1,404 @@
+package server
+
+import (
+	"html"
+	"html/template"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/PuerkitoBio/goquery"
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+
+	titleBoost     = 2.0 // extra score for a query term found in the title
+	snippetTokens  = 30  // number of words shown around the first match
+	maxSnippetSize = 300
+)
+
+var spaceRe = regexp.MustCompile(`\s+`)
+
+// searchToken - word of the page text with its position in the text
+type searchToken struct {
+	term       string
+	start, end int // byte offsets in the text
+}
+
+// searchDoc - indexed page
+type searchDoc struct {
+	key    string
+	title  string
+	text   string // plain text of the page used for snippets
+	tokens []searchToken
+	titles map[string]bool // terms of the title
+	tags   []string
+}
+
+// searchIndex - in-process inverted index of all pages
+type searchIndex struct {
+	docs     map[string]*searchDoc
+	postings map[string]map[string][]int // term -> page key -> positions of the term
+	avgLen   float64
+}
+
+// SearchQuery - parsed search request
+type SearchQuery struct {
+	Terms   []string   // single words
+	Phrases [][]string // "quoted phrases", every phrase is a list of words
+	Folder  string     // only pages below this directory
+	Tag     string     // only pages with this front matter tag
+}
+
+// SearchResult - page found by the query
+type SearchResult struct {
+	Key     string
+	Title   string
+	Snippet template.HTML
+	Tags    []string
+	Score   float64
+}
+
+// tokenize - split the text into lower-cased words
+func tokenize(text string) []searchToken {
+	var tokens []searchToken
+	start := -1
+	for i, r := range text {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWord && start < 0 {
+			start = i
+		} else if !isWord && start >= 0 {
+			tokens = append(tokens, searchToken{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+
+	if start >= 0 {
+		tokens = append(tokens, searchToken{strings.ToLower(text[start:]), start, len(text)})
+	}
+
+	return tokens
+}
+
+// ParseSearchQuery - parse the query string: words, "quoted phrases", folder:dir and tag:name filters
+func ParseSearchQuery(q string) SearchQuery {
+	query := SearchQuery{}
+
+	parts := strings.Split(q, `"`)
+	for i, part := range parts {
+		// odd parts are inside of quotes
+		if i%2 == 1 {
+			var phrase []string
+			for _, t := range tokenize(part) {
+				phrase = append(phrase, t.term)
+			}
+
+			if len(phrase) == 1 {
+				query.Terms = append(query.Terms, phrase[0])
+			} else if len(phrase) > 1 {
+				query.Phrases = append(query.Phrases, phrase)
+			}
+
+			continue
+		}
+
+		for _, field := range strings.Fields(part) {
+			switch {
+			case strings.HasPrefix(field, "folder:"):
+				query.Folder = strings.Trim(strings.TrimPrefix(field, "folder:"), "/")
+			case strings.HasPrefix(field, "tag:"):
+				query.Tag = strings.TrimPrefix(field, "tag:")
+			default:
+				for _, t := range tokenize(field) {
+					query.Terms = append(query.Terms, t.term)
+				}
+			}
+		}
+	}
+
+	return query
+}
+
+// IsEmpty - check if the query has nothing to search for
+func (q SearchQuery) IsEmpty() bool {
+	return len(q.Terms) == 0 && len(q.Phrases) == 0 && q.Folder == "" && q.Tag == ""
+}
+
+// newSearchIndex - index the rendered pages
+func newSearchIndex(pages map[string]*Page) *searchIndex {
+	index := &searchIndex{
+		docs:     make(map[string]*searchDoc),
+		postings: make(map[string]map[string][]int),
+	}
+
+	total := 0
+	for key, page := range pages {
+		doc := &searchDoc{
+			key:    key,
+			title:  page.Title,
+			text:   pageText(page),
+			titles: make(map[string]bool),
+			tags:   page.Meta.Tags,
+		}
+
+		doc.tokens = tokenize(doc.text)
+		for _, t := range tokenize(page.Title) {
+			doc.titles[t.term] = true
+		}
+
+		for pos, t := range doc.tokens {
+			if index.postings[t.term] == nil {
+				index.postings[t.term] = make(map[string][]int)
+			}
+
+			index.postings[t.term][key] = append(index.postings[t.term][key], pos)
+		}
+
+		index.docs[key] = doc
+		total += len(doc.tokens)
+	}
+
+	if len(index.docs) > 0 {
+		index.avgLen = float64(total) / float64(len(index.docs))
+	}
+
+	return index
+}
+
+// pageText - plain text of the rendered page without the table of contents
+func pageText(page *Page) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(string(page.Content)))
+	if err != nil {
+		log.Error(err)
+		return ""
+	}
+
+	doc.Find(".toc").Remove()
+	return strings.TrimSpace(doc.Text())
+}
+
+// Search - find pages which contain all words and phrases of the query, best matches go first
+func (index *searchIndex) Search(query SearchQuery) []SearchResult {
+	results := []SearchResult{}
+	terms := append([]string{}, query.Terms...)
+	for _, phrase := range query.Phrases {
+		terms = append(terms, phrase...)
+	}
+
+	for key, doc := range index.docs {
+		if !query.matchesFilters(doc) {
+			continue
+		}
+
+		score, ok := index.score(doc, terms)
+		if !ok {
+			continue
+		}
+
+		var matches []int // positions of the tokens to highlight
+		for _, term := range query.Terms {
+			matches = append(matches, index.postings[term][key]...)
+		}
+
+		isPhrasesFound := true
+		for _, phrase := range query.Phrases {
+			found := index.findPhrase(key, phrase)
+			if len(found) == 0 {
+				isPhrasesFound = false
+				break
+			}
+
+			matches = append(matches, found...)
+		}
+
+		if !isPhrasesFound {
+			continue
+		}
+
+		results = append(results, SearchResult{
+			Key:     key,
+			Title:   doc.title,
+			Snippet: doc.snippet(matches),
+			Tags:    doc.tags,
+			Score:   score,
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+
+		return results[i].Key < results[j].Key
+	})
+
+	return results
+}
+
+// matchesFilters - check folder and tag filters of the query
+func (q SearchQuery) matchesFilters(doc *searchDoc) bool {
+	if q.Folder != "" && doc.key != q.Folder && !strings.HasPrefix(doc.key, q.Folder+"/") {
+		return false
+	}
+
+	if q.Tag != "" {
+		for _, tag := range doc.tags {
+			if strings.EqualFold(tag, q.Tag) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// score - BM25 score of the document, false in case if any of terms is missing
+func (index *searchIndex) score(doc *searchDoc, terms []string) (float64, bool) {
+	score := 0.0
+	n := float64(len(index.docs))
+	docLen := float64(len(doc.tokens))
+	for _, term := range terms {
+		docs := index.postings[term]
+		tf := float64(len(docs[doc.key]))
+		if tf == 0 && !doc.titles[term] {
+			return 0, false
+		}
+
+		df := float64(len(docs))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*docLen/index.avgLen))
+		if doc.titles[term] {
+			score += titleBoost * idf
+		}
+	}
+
+	return score, true
+}
+
+// findPhrase - positions of all words of every occurrence of the phrase in the document
+func (index *searchIndex) findPhrase(key string, phrase []string) []int {
+	var found []int
+	for _, start := range index.postings[phrase[0]][key] {
+		tokens := index.docs[key].tokens
+		if start+len(phrase) > len(tokens) {
+			continue
+		}
+
+		isMatch := true
+		for i, term := range phrase[1:] {
+			if tokens[start+i+1].term != term {
+				isMatch = false
+				break
+			}
+		}
+
+		if isMatch {
+			for i := range phrase {
+				found = append(found, start+i)
+			}
+		}
+	}
+
+	return found
+}
+
+// snippet - part of the text around the first match with all matches highlighted
+func (doc *searchDoc) snippet(matches []int) template.HTML {
+	if len(doc.tokens) == 0 {
+		return ""
+	}
+
+	sort.Ints(matches)
+	highlight := make(map[int]bool)
+	for _, pos := range matches {
+		highlight[pos] = true
+	}
+
+	first := 0
+	if len(matches) > 0 {
+		first = matches[0] - snippetTokens/3
+		if first < 0 {
+			first = 0
+		}
+	}
+
+	last := first + snippetTokens
+	if last > len(doc.tokens) {
+		last = len(doc.tokens)
+	}
+
+	out := strings.Builder{}
+	if first > 0 {
+		out.WriteString("… ")
+	}
+
+	offset := doc.tokens[first].start
+	for pos := first; pos < last; pos++ {
+		t := doc.tokens[pos]
+		out.WriteString(html.EscapeString(collapseSpaces(doc.text[offset:t.start])))
+		word := html.EscapeString(doc.text[t.start:t.end])
+		if highlight[pos] {
+			word = "<mark>" + word + "</mark>"
+		}
+
+		out.WriteString(word)
+		offset = t.end
+		if out.Len() > maxSnippetSize {
+			last = pos + 1
+			break
+		}
+	}
+
+	if last < len(doc.tokens) {
+		out.WriteString(" …")
+	}
+
+	return template.HTML(out.String())
+}
+
+// collapseSpaces - turn any run of whitespaces into a single space
+func collapseSpaces(s string) string {
+	return spaceRe.ReplaceAllString(s, " ")
+}
+
+// Folders - top level directories which contain indexed pages
+func (index *searchIndex) Folders() []string {
+	set := make(map[string]bool)
+	for key := range index.docs {
+		if dir := path.Dir(key); dir != "." && dir != "/" {
+			set[strings.SplitN(dir, "/", 2)[0]] = true
+		}
+	}
+
+	return sortedKeys(set)
+}
+
+// Tags - all front matter tags of indexed pages
+func (index *searchIndex) Tags() []string {
+	set := make(map[string]bool)
+	for _, doc := range index.docs {
+		for _, tag := range doc.tags {
+			set[tag] = true
+		}
+	}
+
+	return sortedKeys(set)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	index := newSearchIndex(map[string]*Page{
+		"runbooks/db-failover": {Title: "DB failover", Content: "<p>Promote the replica, then fail over the database.</p>", Meta: PageMeta{Tags: []string{"db"}}},
+		"runbooks/cache":       {Title: "Cache", Content: "<p>Flush the cache before the database failover.</p>"},
+		"design/db":            {Title: "Database design", Content: "<p>Over time the replica will fail.</p>"},
+	})
+
+	keys := func(results []SearchResult) string {
+		var out []string
+		for _, r := range results {
+			out = append(out, r.Key)
+		}
+
+		return strings.Join(out, ",")
+	}
+
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{`failover`, "runbooks/db-failover,runbooks/cache"},
+		{`replica`, "design/db,runbooks/db-failover"},
+		{`"fail over"`, "runbooks/db-failover"},
+		{`replica folder:design`, "design/db"},
+		{`database tag:db`, "runbooks/db-failover"},
+		{`missing`, ""},
+	}
+
+	for _, c := range cases {
+		if got := keys(index.Search(ParseSearchQuery(c.query))); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.query, got, c.want)
+		}
+	}
+
+	results := index.Search(ParseSearchQuery(`"fail over"`))
+	if !strings.Contains(string(results[0].Snippet), "<mark>fail</mark> <mark>over</mark>") {
+		t.Errorf("phrase isn't highlighted: %s", results[0].Snippet)
+	}
+}
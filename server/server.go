@@ -3,13 +3,17 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/gin-gonic/gin"
 	"github.com/gobuffalo/packr"
 	"github.com/gorilla/websocket"
 	"html/template"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -30,19 +34,69 @@ type Server struct {
 	clients      map[*websocket.Conn]string
 	clientsMX    sync.Mutex
 	relativePath string
+	mirror       *Mirror       // nil unless the server mirrors the remote repository itself
+	hookSecret   string        // secret of the push webhooks
+	gitSlots     chan struct{} // diff and history requests running git right now
 }
 
+// maxGitRequests - diff and history requests served at once, the rest wait for a free slot
+const maxGitRequests = 4
+
+// gitQueueTimeout - requests waiting longer for a slot get 503
+const gitQueueTimeout = 10 * time.Second
+
 // FrontData - type which keep info about frontend
 type FrontData struct {
 	Url string `json:"url"`
 }
 
+// Options - optional settings of the server
+type Options struct {
+	Bare   bool   // wiki path is a bare repository, files are read from the branch
+	Branch string // branch served from a bare repository, HEAD of the repository if empty
+
+	MirrorURL      string        // remote repository cloned into the wiki path and fetched periodically
+	MirrorInterval time.Duration // delay between fetches
+	MirrorToken    string        // token of https remotes
+	MirrorSSHKey   string        // private key of ssh remotes
+	HookSecret     string        // secret of push webhooks which fetch the mirror right away
+
+	GitBackend string // how the history is read: auto, go or exec, auto if empty
+}
+
 // NewServer - create new instance a Server instance
-func NewServer(address, relativePath, wikiPath string) *Server {
+func NewServer(address, relativePath, wikiPath string, options Options) *Server {
 	message := make(chan interface{}, 100)
+
+	// the server starts before the wiki is cloned, so the status of the mirror tells why there are no pages
+	var mirror *Mirror
+	if options.MirrorURL != "" {
+		mirror = NewMirror(options.MirrorURL, wikiPath, options.Bare, options.Branch, options.MirrorInterval,
+			options.MirrorToken, options.MirrorSSHKey)
+		if err := os.MkdirAll(wikiPath, 0755); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	renderer := NewRenderer(wikiPath, message)
+	if options.Bare {
+		renderer = NewBareRenderer(wikiPath, options.Branch, message)
+	}
+
+	if options.GitBackend != "" && options.GitBackend != GitBackendAuto {
+		renderer.backend = newGitBackend(renderer.gitDir, options.GitBackend)
+	}
+
 	renderer.Run()
 
+	if mirror != nil {
+		go func() {
+			mirror.Init()
+			renderer.Rescan()
+			mirror.Run()
+		}()
+	}
+
 	relativePath = strings.TrimLeft(relativePath, "/")
 	relativePath = "/" + relativePath
 
@@ -52,6 +106,9 @@ func NewServer(address, relativePath, wikiPath string) *Server {
 		clients:      make(map[*websocket.Conn]string),
 		message:      message,
 		relativePath: relativePath,
+		mirror:       mirror,
+		hookSecret:   options.HookSecret,
+		gitSlots:     make(chan struct{}, maxGitRequests),
 	}
 }
 
@@ -76,8 +133,26 @@ func (s *Server) routes() *gin.Engine {
 		s.clients[conn] = frontRequest.Url
 	})
 
-	v1.GET("/history/:first/:second", func(c *gin.Context) {
-		templateTxt := box.String("compare.html")
+	v1.GET("/history/:first/:second", s.limitGit, func(c *gin.Context) {
+		first, err := s.renderer.ResolveRevision(c.Param("first"))
+		if err != nil {
+			c.AbortWithError(gitErrorStatus(err, http.StatusNotFound), err)
+			return
+		}
+
+		second, err := s.renderer.ResolveRevision(c.Param("second"))
+		if err != nil {
+			c.AbortWithError(gitErrorStatus(err, http.StatusNotFound), err)
+			return
+		}
+
+		files, err := s.renderer.GetFileDiffs(first, second, c.QueryArray("path")...)
+		if err != nil {
+			c.AbortWithError(gitErrorStatus(err, http.StatusInternalServerError), err)
+			return
+		}
+
+		templateTxt := box.String("compare.html") + box.String("diff.html")
 
 		t, err := template.New("compare").Parse(templateTxt)
 		if err != nil {
@@ -86,19 +161,20 @@ func (s *Server) routes() *gin.Engine {
 
 		styles := box.String("styles.html")
 
-		history, count := s.renderer.GetHistory(2, 0)
 		c.Status(http.StatusOK)
 		err = t.ExecuteTemplate(c.Writer, "compare", struct {
 			Styles       template.HTML
-			Diff         string
-			Commits      []GitLog
-			Count        int
+			First        string
+			Second       string
+			Files        []FileDiff
+			Layout       DiffLayout
 			RelativePath string
 		}{
 			template.HTML(styles),
-			s.renderer.GetDiff(c.Param("first"), c.Param("second")),
-			history,
-			count,
+			c.Param("first"),
+			c.Param("second"),
+			files,
+			diffLayout(c),
 			s.relativePath,
 		})
 		if err != nil {
@@ -106,19 +182,34 @@ func (s *Server) routes() *gin.Engine {
 		}
 	})
 
-	v1.GET("/history", func(c *gin.Context) {
-		templateTxt := box.String("history.html")
-		pageParam := c.Query("page")
-		limitParam := c.Query("limit")
+	v1.GET("/commit/:sha", s.limitGit, s.commit)
+
+	v1.GET("/_blob/:sha/:name", s.limitGit, s.blob)
 
-		limit, _ := strconv.Atoi(limitParam)
-		if limit == 0 {
-			limit = 10
+	v1.GET("/_deleted", s.deletedList)
+
+	v1.GET("/_deleted/*file", s.limitGit, s.deletedPage)
+
+	v1.POST("/_hooks/push", s.pushHook)
+
+	v1.GET("/_mirror.json", func(c *gin.Context) {
+		if s.mirror == nil {
+			c.AbortWithError(http.StatusNotFound, fmt.Errorf("Mirroring is not configured"))
+			return
 		}
 
-		page, _ := strconv.Atoi(pageParam)
-		if page == 0 {
-			page = 1
+		c.JSON(http.StatusOK, s.mirror.Status())
+	})
+
+	v1.GET("/history", s.limitGit, func(c *gin.Context) {
+		templateTxt := box.String("history.html")
+		page, limit := pageParams(c)
+		filter := HistoryFilter{
+			Path:   c.Query("path"),
+			Author: c.Query("author"),
+			Since:  c.Query("since"),
+			Until:  c.Query("until"),
+			Grep:   c.Query("grep"),
 		}
 
 		t, err := template.New("history").Parse(templateTxt)
@@ -128,40 +219,20 @@ func (s *Server) routes() *gin.Engine {
 
 		styles := box.String("styles.html")
 
-		history, count := s.renderer.GetHistory(limit, (page-1)*limit)
-
-		pages := []int{}
-		rightCount := 2
-		leftCount := 2
-
-		if count-page < 2 {
-			leftCount += 2 - (count - page)
-			rightCount -= 2 - (count - page)
-		}
-
-		if page < 3 {
-			rightCount += 2 - (page - 1)
-			leftCount -= 2 - (page - 1)
-		}
-
-		for i := leftCount; i > 0; i-- {
-			if page-i > 0 {
-				pages = append(pages, page-i)
-			}
+		history, count, err := s.renderer.GetHistory(filter, limit, (page-1)*limit)
+		if err != nil {
+			c.AbortWithError(gitErrorStatus(err, http.StatusBadRequest), err)
+			return
 		}
 
-		pages = append(pages, page)
-
-		for i := 0; i < rightCount; i++ {
-			if page+i+1 <= count {
-				pages = append(pages, page+i+1)
-			}
-		}
+		pages := pagination(page, count)
 
 		c.Status(http.StatusOK)
 		err = t.ExecuteTemplate(c.Writer, "history", struct {
 			Commits      []GitLog
 			Count        int
+			Filter       HistoryFilter
+			Query        template.URL
 			Styles       template.HTML
 			RelativePath string
 			Page         int
@@ -172,6 +243,8 @@ func (s *Server) routes() *gin.Engine {
 		}{
 			history,
 			count,
+			filter,
+			historyQuery(filter),
 			template.HTML(styles),
 			s.relativePath,
 			page,
@@ -185,6 +258,88 @@ func (s *Server) routes() *gin.Engine {
 		}
 	})
 
+	v1.GET("/search", func(c *gin.Context) {
+		templateTxt := box.String("search.html")
+
+		t, err := template.New("search").Parse(templateTxt)
+		if err != nil {
+			log.Error(err)
+		}
+
+		queryParam := c.Query("q")
+		query := ParseSearchQuery(queryParam)
+		if folder := c.Query("folder"); folder != "" {
+			query.Folder = strings.Trim(folder, "/")
+		}
+
+		if tag := c.Query("tag"); tag != "" {
+			query.Tag = tag
+		}
+
+		var results []SearchResult
+		if !query.IsEmpty() {
+			results = s.renderer.Search(query)
+		}
+
+		folders, tags := s.renderer.GetSearchFilters()
+		styles := box.String("styles.html")
+
+		c.Status(http.StatusOK)
+		err = t.ExecuteTemplate(c.Writer, "search", struct {
+			Query        string
+			Folder       string
+			Tag          string
+			Folders      []string
+			Tags         []string
+			Results      []SearchResult
+			IsSearched   bool
+			Styles       template.HTML
+			RelativePath string
+		}{
+			queryParam,
+			query.Folder,
+			query.Tag,
+			folders,
+			tags,
+			results,
+			!query.IsEmpty(),
+			template.HTML(styles),
+			s.relativePath,
+		})
+		if err != nil {
+			log.Error(err)
+		}
+	})
+
+	v1.GET("/_broken-links", func(c *gin.Context) {
+		templateTxt := box.String("broken_links.html")
+
+		t, err := template.New("broken_links").Parse(templateTxt)
+		if err != nil {
+			log.Error(err)
+		}
+
+		styles := box.String("styles.html")
+
+		c.Status(http.StatusOK)
+		err = t.ExecuteTemplate(c.Writer, "broken_links", struct {
+			Pages        []BrokenLinks
+			Styles       template.HTML
+			RelativePath string
+		}{
+			s.renderer.GetBrokenLinks(),
+			template.HTML(styles),
+			s.relativePath,
+		})
+		if err != nil {
+			log.Error(err)
+		}
+	})
+
+	v1.GET("/_broken-links.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, s.renderer.GetBrokenLinks())
+	})
+
 	v1.GET("/all_files", func(c *gin.Context) {
 		templateTxt := box.String("all_files.html")
 
@@ -213,13 +368,14 @@ func (s *Server) routes() *gin.Engine {
 
 		bf.Flush()
 		page.Content = &Page{Content: template.HTML(content.String())}
+		page.Mirror = s.mirrorStatus()
 
 		styles := box.String("styles.html")
 
 		c.Status(http.StatusOK)
 		err = t.ExecuteTemplate(c.Writer, "index", struct {
 			Page         CommonPage
-			Pages        map[string]string
+			Pages        map[string]*Page
 			RelativePath string
 			Styles       template.HTML
 		}{page,
@@ -239,58 +395,592 @@ func (s *Server) routes() *gin.Engine {
 			return
 		}
 
-		templateTxt := box.String("index.html")
-		t, err := template.New("index").Parse(templateTxt)
-		if err != nil {
-			log.Error(err)
-		}
-
 		path := c.Request.URL.Path
-		if s.relativePath != "" {
-			if strings.Contains(path, s.relativePath) == false {
-				c.AbortWithError(http.StatusNotFound, err)
+		if s.relativePath != "/" {
+			if strings.HasPrefix(path, s.relativePath) == false {
+				c.AbortWithError(http.StatusNotFound, fmt.Errorf("Can't find the page"))
 				return
 			}
 
-			path = strings.Replace(path, s.relativePath, "", -1)
+			path = strings.TrimPrefix(path, s.relativePath)
 		}
 
-		page, err := s.renderer.GetPage(filepath.Base(path))
-		if err != nil {
-			statName := filepath.Base(c.Request.URL.Path)
-			stat, err := os.Stat(filepath.Join(s.renderer.path, statName))
-			if err == nil && stat.IsDir() == false {
-				c.File(filepath.Join(s.renderer.path, statName))
+		if strings.HasPrefix(path, "/_ref/") {
+			if !s.acquireGit(c) {
 				return
 			}
 
-			c.AbortWithError(http.StatusNotFound, err)
+			defer s.releaseGit()
+			s.refPage(c)
 			return
 		}
 
-		pages := s.renderer.GetPages()
+		// ?ref= switches to the same page at the ref
+		if ref := c.Query("ref"); ref != "" {
+			c.Redirect(http.StatusFound, strings.TrimSuffix(s.relativePath, "/")+WikiRef{Name: ref}.URL()+(&url.URL{Path: path}).EscapedPath())
+			return
+		}
 
-		styles := box.String("styles.html")
+		key, action, args := splitPageAction(urlKey(path))
+		if target, ok := s.renderer.GetRedirect(key); ok {
+			s.redirectPage(c, http.StatusMovedPermanently, "", target, action, args...)
+			return
+		}
 
-		c.Status(http.StatusOK)
-		err = t.ExecuteTemplate(c.Writer, "index", struct {
-			Page         CommonPage
-			Pages        map[string]string
-			RelativePath string
-			Styles       template.HTML
-		}{page,
-			pages,
-			s.relativePath,
-			template.HTML(styles),
-		})
+		switch action {
+		case "_history", "_rev", "_blame", "_changes":
+			if !s.acquireGit(c) {
+				return
+			}
+
+			defer s.releaseGit()
+		}
+
+		switch action {
+		case "_backlinks":
+			s.pageBacklinks(c, key)
+			return
+		case "_history":
+			s.pageHistory(c, key)
+			return
+		case "_rev":
+			s.pageRevision(c, key, args)
+			return
+		case "_blame":
+			s.pageBlame(c, key)
+			return
+		case "_changes":
+			s.pageChanges(c, key, args)
+			return
+		}
+
+		page, err := s.renderer.GetPage(key)
 		if err != nil {
-			log.Error(err)
+			s.attachment(c, s.renderer, key)
+			return
 		}
+
+		s.renderPage(c, page)
 	})
 
 	return r
 }
 
+// refPage - page or attachment of the wiki at the branch, tag, commit or date: /_ref/<ref>/<page>
+func (s *Server) refPage(c *gin.Context) {
+	// the ref is taken from the escaped path, so refs like feature%2Fnew keep their slash
+	escaped := strings.TrimPrefix(c.Request.URL.EscapedPath(), strings.TrimSuffix(s.relativePath, "/"))
+	parts := strings.SplitN(strings.TrimPrefix(escaped, "/_ref/"), "/", 2)
+	name, err := url.PathUnescape(parts[0])
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	path := "/"
+	if len(parts) == 2 {
+		if path, err = url.PathUnescape("/" + parts[1]); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	ref, err := s.renderer.ResolveRef(name)
+	if err != nil {
+		c.AbortWithError(gitErrorStatus(err, http.StatusNotFound), err)
+		return
+	}
+
+	renderer, err := s.renderer.Snapshot(ref.Commit.Commit)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+
+	key := urlKey(path)
+	// refs like branches move, so their redirects are not permanent
+	if target, ok := renderer.GetRedirect(key); ok {
+		s.redirectPage(c, http.StatusFound, WikiRef{Name: name}.URL(), target, "")
+		return
+	}
+
+	page, err := renderer.GetPage(key)
+	if err != nil {
+		s.attachment(c, renderer, key)
+		return
+	}
+
+	page.Ref = ref
+	s.renderPageOf(c, renderer, page)
+}
+
+// redirectPage - redirect to the view of the page under the prefix, the query is kept
+func (s *Server) redirectPage(c *gin.Context, code int, prefix, key, action string, args ...string) {
+	location := strings.TrimSuffix(s.relativePath, "/") + prefix + (&url.URL{Path: pageActionURL(key, action, args...)}).EscapedPath()
+	if query := c.Request.URL.RawQuery; query != "" {
+		location += "?" + query
+	}
+
+	c.Redirect(code, location)
+}
+
+// attachment - file of the wiki which is not a page, hidden files are never exposed
+func (s *Server) attachment(c *gin.Context, renderer *Renderer, key string) {
+	file := strings.TrimPrefix(key, "/")
+	if file == "" || isHiddenPath(file) {
+		c.AbortWithError(http.StatusNotFound, fmt.Errorf("Can't find the page"))
+		return
+	}
+
+	// files of the docroot are served from the disk, the ones of git trees from memory
+	if name, ok := renderer.FilePath(file); ok {
+		stat, err := os.Stat(name)
+		if err != nil || stat.IsDir() {
+			c.AbortWithError(http.StatusNotFound, fmt.Errorf("Can't find the page"))
+			return
+		}
+
+		c.File(name)
+		return
+	}
+
+	bts, err := renderer.ReadFile(file)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(file))
+	if contentType == "" {
+		contentType = http.DetectContentType(bts)
+	}
+
+	c.Data(http.StatusOK, contentType, bts)
+}
+
+// mirrorStatus - state of the mirror shown in the footer, nil if rowi doesn't sync a remote repository
+func (s *Server) mirrorStatus() *MirrorStatus {
+	if s.mirror == nil {
+		return nil
+	}
+
+	status := s.mirror.Status()
+	return &status
+}
+
+// renderPage - render the page with all common parts of the wiki
+func (s *Server) renderPage(c *gin.Context, page CommonPage) {
+	s.renderPageOf(c, s.renderer, page)
+}
+
+// renderPageOf - render the page of the wiki, which is the live one or a snapshot at some ref
+func (s *Server) renderPageOf(c *gin.Context, renderer *Renderer, page CommonPage) {
+	box := packr.NewBox("templates/")
+	templateTxt := box.String("index.html")
+	t, err := template.New("index").Parse(templateTxt)
+	if err != nil {
+		log.Error(err)
+	}
+
+	pages := renderer.GetPages()
+	page.Mirror = s.mirrorStatus()
+
+	styles := box.String("styles.html")
+
+	c.Status(http.StatusOK)
+	err = t.ExecuteTemplate(c.Writer, "index", struct {
+		Page         CommonPage
+		Pages        map[string]*Page
+		RelativePath string
+		Styles       template.HTML
+	}{page,
+		pages,
+		s.relativePath,
+		template.HTML(styles),
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// commit - details of the commit with changed files and diffs of the pages
+func (s *Server) commit(c *gin.Context) {
+	commit, files, err := s.renderer.GetCommit(c.Param("sha"))
+	if err != nil {
+		c.AbortWithError(gitErrorStatus(err, http.StatusNotFound), err)
+		return
+	}
+
+	box := packr.NewBox("templates/")
+	templateTxt := box.String("commit.html") + box.String("diff.html")
+	t, err := template.New("commit").Parse(templateTxt)
+	if err != nil {
+		log.Error(err)
+	}
+
+	styles := box.String("styles.html")
+
+	c.Status(http.StatusOK)
+	err = t.ExecuteTemplate(c.Writer, "commit", struct {
+		Commit       *GitLog
+		Parents      []string
+		Files        []ChangedFile
+		Layout       DiffLayout
+		Styles       template.HTML
+		RelativePath string
+	}{
+		commit,
+		strings.Fields(commit.Parent),
+		files,
+		diffLayout(c),
+		template.HTML(styles),
+		s.relativePath,
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// deletedList - pages which are gone from the wiki with the commits which deleted them
+func (s *Server) deletedList(c *gin.Context) {
+	box := packr.NewBox("templates/")
+	templateTxt := box.String("deleted.html")
+	t, err := template.New("deleted").Parse(templateTxt)
+	if err != nil {
+		log.Error(err)
+	}
+
+	styles := box.String("styles.html")
+
+	c.Status(http.StatusOK)
+	err = t.ExecuteTemplate(c.Writer, "deleted", struct {
+		Pages        []DeletedPage
+		Styles       template.HTML
+		RelativePath string
+	}{
+		s.renderer.GetDeletedPages(),
+		template.HTML(styles),
+		s.relativePath,
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// deletedPage - last version of the deleted page, read-only
+func (s *Server) deletedPage(c *gin.Context) {
+	page, err := s.renderer.GetDeletedPage(strings.TrimPrefix(c.Param("file"), "/"))
+	if err != nil {
+		c.AbortWithError(gitErrorStatus(err, http.StatusNotFound), err)
+		return
+	}
+
+	s.renderPage(c, page)
+}
+
+// blob - file stored in git, used to show old and new versions of images in diffs
+func (s *Server) blob(c *gin.Context) {
+	bts, err := s.renderer.GetBlob(c.Param("sha"))
+	if err != nil {
+		c.AbortWithError(gitErrorStatus(err, http.StatusNotFound), err)
+		return
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(c.Param("name")))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// svg images may carry scripts, they are shown as images only
+	c.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Data(http.StatusOK, contentType, bts)
+}
+
+// pageRevision - the page as it was in the revision: /<page>/_rev/<sha>
+func (s *Server) pageRevision(c *gin.Context, key string, args []string) {
+	if len(args) != 1 {
+		c.AbortWithError(http.StatusNotFound, fmt.Errorf("Revision is expected"))
+		return
+	}
+
+	page, err := s.renderer.GetPageRevision(key, args[0], c.Query("path"))
+	if err != nil {
+		c.AbortWithError(gitErrorStatus(err, http.StatusNotFound), err)
+		return
+	}
+
+	s.renderPage(c, page)
+}
+
+// pageChanges - word level diff of the page between two revisions: /<page>/_changes/<first>/<second>
+func (s *Server) pageChanges(c *gin.Context, key string, args []string) {
+	if len(args) != 2 {
+		c.AbortWithError(http.StatusNotFound, fmt.Errorf("Two revisions are expected"))
+		return
+	}
+
+	page, err := s.renderer.GetPageChanges(key, args[0], args[1], c.Query("prev"), c.Query("path"))
+	if err != nil {
+		c.AbortWithError(gitErrorStatus(err, http.StatusNotFound), err)
+		return
+	}
+
+	s.renderPage(c, page)
+}
+
+// pageBlame - author, date and commit of every line of the page source
+func (s *Server) pageBlame(c *gin.Context, key string) {
+	page, err := s.renderer.GetPage(key)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+
+	blocks, err := s.renderer.GetBlame(page.Content.Path)
+	if err != nil {
+		c.AbortWithError(gitErrorStatus(err, http.StatusNotFound), err)
+		return
+	}
+
+	box := packr.NewBox("templates/")
+	templateTxt := box.String("blame.html")
+	t, err := template.New("blame").Parse(templateTxt)
+	if err != nil {
+		log.Error(err)
+	}
+
+	styles := box.String("styles.html")
+
+	c.Status(http.StatusOK)
+	err = t.ExecuteTemplate(c.Writer, "blame", struct {
+		Page         *Page
+		Blocks       []BlameBlock
+		Styles       template.HTML
+		RelativePath string
+	}{
+		page.Content,
+		blocks,
+		template.HTML(styles),
+		s.relativePath,
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// pageBacklinks - list of pages which link to the page
+func (s *Server) pageBacklinks(c *gin.Context, key string) {
+	backlinks, ok := s.renderer.GetBacklinks(key)
+	if !ok {
+		c.AbortWithError(http.StatusNotFound, fmt.Errorf("Can't find the page"))
+		return
+	}
+
+	// urls of the json are absolute like the links of the rendered pages
+	refs := make([]PageRef, len(backlinks))
+	for i, ref := range backlinks {
+		ref.URL = strings.TrimSuffix(s.relativePath, "/") + ref.URL
+		refs[i] = ref
+	}
+
+	c.JSON(http.StatusOK, refs)
+}
+
+// pageHistory - list of commits which changed the page
+func (s *Server) pageHistory(c *gin.Context, key string) {
+	page, err := s.renderer.GetPage(key)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+
+	box := packr.NewBox("templates/")
+	templateTxt := box.String("page_history.html")
+	t, err := template.New("page_history").Parse(templateTxt)
+	if err != nil {
+		log.Error(err)
+	}
+
+	pageNum, limit := pageParams(c)
+	history, count, err := s.renderer.GetFileHistory(page.Content.Path, limit, (pageNum-1)*limit)
+	if err != nil {
+		c.AbortWithError(gitErrorStatus(err, http.StatusInternalServerError), err)
+		return
+	}
+
+	styles := box.String("styles.html")
+
+	c.Status(http.StatusOK)
+	err = t.ExecuteTemplate(c.Writer, "page_history", struct {
+		Page         *Page
+		Revisions    []FileRevision
+		Count        int
+		Styles       template.HTML
+		RelativePath string
+		PageNum      int
+		PrevPage     int
+		NextPage     int
+		Limit        int
+		Pages        []int
+	}{
+		page.Content,
+		history,
+		count,
+		template.HTML(styles),
+		s.relativePath,
+		pageNum,
+		pageNum - 1,
+		pageNum + 1,
+		limit,
+		pagination(pageNum, count),
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// pageParams - page number and page size of the paginated list
+func pageParams(c *gin.Context) (page, limit int) {
+	limit, _ = strconv.Atoi(c.Query("limit"))
+	if limit <= 0 {
+		limit = 10
+	}
+
+	page, _ = strconv.Atoi(c.Query("page"))
+	if page <= 0 {
+		page = 1
+	}
+
+	return page, limit
+}
+
+// limitGit - middleware which keeps the number of diff and history requests running git at once
+// under maxGitRequests
+func (s *Server) limitGit(c *gin.Context) {
+	if !s.acquireGit(c) {
+		return
+	}
+
+	defer s.releaseGit()
+	c.Next()
+}
+
+// acquireGit - wait for a free slot, the request is aborted with 503 if it doesn't come in time
+func (s *Server) acquireGit(c *gin.Context) bool {
+	timer := time.NewTimer(gitQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case s.gitSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-c.Request.Context().Done():
+	}
+
+	c.Header("Retry-After", strconv.Itoa(int(gitQueueTimeout.Seconds())))
+	c.AbortWithError(http.StatusServiceUnavailable, fmt.Errorf("Too many requests to the history, try again later"))
+	return false
+}
+
+// releaseGit - free the slot taken by acquireGit
+func (s *Server) releaseGit() {
+	<-s.gitSlots
+}
+
+// gitErrorStatus - response status of the git error: 400 for revisions which are not in the repository,
+// 503 when git took too long, the fallback status otherwise
+func gitErrorStatus(err error, fallback int) int {
+	if _, ok := err.(RevisionError); ok {
+		return http.StatusBadRequest
+	}
+
+	if err == ErrGitTimeout {
+		return http.StatusServiceUnavailable
+	}
+
+	return fallback
+}
+
+// DiffLayout - layout of the diff requested with ?layout= and links switching it
+type DiffLayout struct {
+	Name      string
+	InlineURL template.URL
+	SplitURL  template.URL
+}
+
+// diffLayout - layout of the diff, side by side unless inline is requested
+func diffLayout(c *gin.Context) DiffLayout {
+	link := func(name string) template.URL {
+		query := c.Request.URL.Query()
+		query.Set("layout", name)
+		return template.URL("?" + query.Encode())
+	}
+
+	layout := DiffLayout{Name: DiffSplit, InlineURL: link(DiffInline), SplitURL: link(DiffSplit)}
+	if c.Query("layout") == DiffInline {
+		layout.Name = DiffInline
+	}
+
+	return layout
+}
+
+// historyQuery - filters of the history as query parameters, pagination links keep them
+func historyQuery(filter HistoryFilter) template.URL {
+	values := url.Values{}
+	for name, value := range map[string]string{
+		"path":   filter.Path,
+		"author": filter.Author,
+		"since":  filter.Since,
+		"until":  filter.Until,
+		"grep":   filter.Grep,
+	} {
+		if value != "" {
+			values.Set(name, value)
+		}
+	}
+
+	if len(values) == 0 {
+		return ""
+	}
+
+	return template.URL("&" + values.Encode())
+}
+
+// pagination - numbers of pages shown around the current one
+func pagination(page, count int) []int {
+	pages := []int{}
+	rightCount := 2
+	leftCount := 2
+
+	if count-page < 2 {
+		leftCount += 2 - (count - page)
+		rightCount -= 2 - (count - page)
+	}
+
+	if page < 3 {
+		rightCount += 2 - (page - 1)
+		leftCount -= 2 - (page - 1)
+	}
+
+	for i := leftCount; i > 0; i-- {
+		if page-i > 0 {
+			pages = append(pages, page-i)
+		}
+	}
+
+	pages = append(pages, page)
+
+	for i := 0; i < rightCount; i++ {
+		if page+i+1 <= count {
+			pages = append(pages, page+i+1)
+		}
+	}
+
+	return pages
+}
+
 func (s *Server) worker() {
 	for {
 		<-s.message
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAcquireGit(t *testing.T) {
+	s := &Server{gitSlots: make(chan struct{}, 1)}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/history", nil)
+	if !s.acquireGit(c) {
+		t.Fatalf("the free slot is not acquired")
+	}
+
+	// the client is gone while it waits for the slot
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/history", nil).WithContext(ctx)
+	if s.acquireGit(c) {
+		t.Fatalf("the busy slot is acquired")
+	}
+
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("unexpected response: %d %v", w.Code, w.Header())
+	}
+
+	s.releaseGit()
+	if len(s.gitSlots) != 0 {
+		t.Errorf("the slot is not released")
+	}
+}
+
+func TestGitErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{RevisionError{"--output=x"}, http.StatusBadRequest},
+		{ErrGitTimeout, http.StatusServiceUnavailable},
+		{fmt.Errorf("exit status 128"), http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		if status := gitErrorStatus(test.err, http.StatusNotFound); status != test.status {
+			t.Errorf("gitErrorStatus(%v) = %d, want %d", test.err, status, test.status)
+		}
+	}
+}
+
+func TestPageBacklinks(t *testing.T) {
+	r := NewRenderer(writeDocroot(t, map[string]string{
+		"notes.md":            "# Notes\n",
+		"runbooks/on call.md": "# On call\n\n[Notes](../notes.md)\n",
+	}), make(chan interface{}, 1))
+	r.scanStorage()
+
+	s := &Server{renderer: r, relativePath: "/wiki/"}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/wiki/notes/_backlinks", nil)
+	s.pageBacklinks(c, "notes")
+
+	var backlinks []PageRef
+	if err := json.Unmarshal(w.Body.Bytes(), &backlinks); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("unexpected response: %d %s", w.Code, w.Body)
+	}
+
+	expected := []PageRef{{Key: "runbooks/on call", Title: "On call", URL: "/wiki/runbooks/on%20call"}}
+	if !reflect.DeepEqual(backlinks, expected) {
+		t.Errorf("expected %+v, got %+v", expected, backlinks)
+	}
+
+	// the cached backlinks of the renderer keep urls without the prefix
+	if cached, _ := r.GetBacklinks("notes"); cached[0].URL != "/runbooks/on%20call" {
+		t.Errorf("unexpected cached backlinks: %+v", cached)
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Storage - source of the wiki files, paths are slash separated and relative to the docroot
+type Storage interface {
+	// Files - all files of the wiki, hidden directories like .git are skipped
+	Files() ([]string, error)
+	// ReadFile - content of the file
+	ReadFile(path string) ([]byte, error)
+}
+
+// fsStorage - files of the docroot directory
+type fsStorage struct {
+	root string
+}
+
+// Files - collect all files below the docroot
+func (s fsStorage) Files() (files []string, err error) {
+	err = filepath.Walk(s.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if rel != "." && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+
+	return
+}
+
+// ReadFile - content of the file below the docroot
+func (s fsStorage) ReadFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(s.root, filepath.FromSlash(path)))
+}
+
+// gitStorage - files of the git tree at the commit
+type gitStorage struct {
+	r      *Renderer
+	commit string
+	files  []string
+	blobs  map[string]string // path -> object name
+	cache  map[string][]byte // content of pages read ahead in a single git call
+}
+
+// newGitStorage - list files of the commit and read all pages ahead
+func newGitStorage(r *Renderer, commit string) (*gitStorage, error) {
+	files, err := r.backend.Tree(commit)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read the tree of %s: %v", commit, err)
+	}
+
+	s := &gitStorage{r: r, commit: commit, blobs: make(map[string]string)}
+	var pages []string
+	for _, file := range files {
+		if isHiddenPath(file.Path) {
+			continue
+		}
+
+		s.files = append(s.files, file.Path)
+		s.blobs[file.Path] = file.Blob
+		if strings.HasSuffix(strings.ToLower(file.Path), ".md") {
+			pages = append(pages, file.Blob)
+		}
+	}
+
+	s.cache, err = r.backend.Blobs(pages)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Files - all files of the tree
+func (s *gitStorage) Files() ([]string, error) {
+	return s.files, nil
+}
+
+// ReadFile - content of the file in the tree
+func (s *gitStorage) ReadFile(path string) ([]byte, error) {
+	blob, ok := s.blobs[path]
+	if !ok {
+		return nil, fmt.Errorf("Can't find %s in %s", path, s.commit)
+	}
+
+	if bts, ok := s.cache[blob]; ok {
+		return bts, nil
+	}
+
+	return s.r.backend.Show(blob, "")
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"html/template"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	log "github.com/Sirupsen/logrus"
+)
+
+// TOCEntry - heading of the page in the table of contents
+type TOCEntry struct {
+	Level    int         `json:"level"`
+	ID       string      `json:"id"` // anchor generated by sanitized_anchor_name
+	Title    string      `json:"title"`
+	Children []*TOCEntry `json:"children,omitempty"`
+}
+
+// tocMarkerRe - [[_TOC_]] marker as markdown renders it, usually a separate paragraph.
+// Inside of code blocks the marker isn't turned into emphasis, so it is left as is there.
+var tocMarkerRe = regexp.MustCompile(`(?:<p>\s*)?\[\[<em>TOC</em>\]\](?:\s*</p>)?`)
+
+var tocTemplate = template.Must(template.New("toc").Parse(`{{define "toc"}}<ul>{{range .}}
+<li><a href="#{{.ID}}">{{.Title}}</a>{{if .Children}}{{template "toc" .Children}}{{end}}</li>{{end}}
+</ul>{{end}}`))
+
+// buildTOC - build the heading hierarchy of the rendered page
+func buildTOC(content string) []*TOCEntry {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(content))
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+
+	var toc []*TOCEntry
+	var stack []*TOCEntry
+	doc.Find("h1, h2, h3, h4, h5, h6").Each(func(_ int, s *goquery.Selection) {
+		id, _ := s.Find("a.anchor").Attr("name")
+		entry := &TOCEntry{
+			Level: int(goquery.NodeName(s)[1] - '0'),
+			ID:    id,
+			Title: strings.TrimSpace(s.Text()),
+		}
+
+		// the closest previous heading with a lower level is the parent
+		for len(stack) > 0 && stack[len(stack)-1].Level >= entry.Level {
+			stack = stack[:len(stack)-1]
+		}
+
+		if len(stack) == 0 {
+			toc = append(toc, entry)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, entry)
+		}
+
+		stack = append(stack, entry)
+	})
+
+	return toc
+}
+
+// renderTOC - render the table of contents as nested lists
+func renderTOC(toc []*TOCEntry) template.HTML {
+	if len(toc) == 0 {
+		return ""
+	}
+
+	out := bytes.Buffer{}
+	if err := tocTemplate.ExecuteTemplate(&out, "toc", toc); err != nil {
+		log.Error(err)
+		return ""
+	}
+
+	return template.HTML(out.String())
+}
+
+// insertTOC - replace [[_TOC_]] markers in the rendered page with the table of contents
+func insertTOC(content string, toc template.HTML) string {
+	return tocMarkerRe.ReplaceAllLiteralString(content, `<div class="toc">`+string(toc)+`</div>`)
+}
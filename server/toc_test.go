@@ -0,0 +1,23 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/shurcooL/github_flavored_markdown"
+)
+
+func TestBuildTOC(t *testing.T) {
+	md := "# Runbook\n\n[[_TOC_]]\n\n## Prepare\n\n### Check `replicas`\n\n## Fail over\n\n```\n[[_TOC_]]\n```\n"
+	content := string(github_flavored_markdown.Markdown([]byte(md)))
+
+	toc := buildTOC(content)
+	if len(toc) != 1 || len(toc[0].Children) != 2 || toc[0].Children[0].Children[0].ID != "check-replicas" {
+		t.Fatalf("unexpected toc: %+v", toc)
+	}
+
+	content = insertTOC(content, renderTOC(toc))
+	if strings.Count(content, `<div class="toc">`) != 1 || !strings.Contains(content, "[[_TOC_]]") {
+		t.Errorf("only the marker outside of code has to be replaced: %s", content)
+	}
+}
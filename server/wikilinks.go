@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// wikiLinkRe - [[Page Name]] or [[Link Text|Page Name]] left as is by markdown
+var wikiLinkRe = regexp.MustCompile(`\[\[([^\[\]<>]+)\]\]`)
+
+// codeRe - parts of the rendered page where wiki links are not expanded
+var codeRe = regexp.MustCompile(`(?is)<pre[ >].*?</pre>|<code[ >].*?</code>`)
+
+// replaceOutsideCode - apply the replacement to the html content except code blocks
+func replaceOutsideCode(content string, re *regexp.Regexp, repl func(string) string) string {
+	out := strings.Builder{}
+	last := 0
+	for _, loc := range codeRe.FindAllStringIndex(content, -1) {
+		out.WriteString(re.ReplaceAllStringFunc(content[last:loc[0]], repl))
+		out.WriteString(content[loc[0]:loc[1]])
+		last = loc[1]
+	}
+
+	out.WriteString(re.ReplaceAllStringFunc(content[last:], repl))
+	return out.String()
+}
+
+// renderWikiLinks - turn GitHub wiki links of the file into links to the pages,
+// links to pages which don't exist get "wiki-link-missing" class
+func renderWikiLinks(content, from string, index *pageIndex) (string, []PageLink) {
+	var links []PageLink
+	content = replaceOutsideCode(content, wikiLinkRe, func(link string) string {
+		label := wikiLinkRe.FindStringSubmatch(link)[1]
+		target := label
+		if i := strings.Index(label, "|"); i >= 0 {
+			label, target = label[:i], label[i+1:]
+		}
+
+		label = strings.TrimSpace(label)
+		target, fragment := html.UnescapeString(target), ""
+		if i := strings.Index(target, "#"); i >= 0 {
+			target, fragment = target[:i], target[i+1:]
+		}
+
+		class := "wiki-link"
+		if strings.TrimSpace(target) == "" {
+			// [[#anchor]] points to the same page
+			return fmt.Sprintf(`<a class="%s" href="#%s">%s</a>`, class, html.EscapeString(fragment), label)
+		}
+
+		key, ok := index.resolveWiki(from, target)
+		if !ok {
+			class += " wiki-link-missing"
+		}
+
+		pageLink := PageLink{Key: key, Fragment: fragment, IsFound: ok}
+		links = append(links, pageLink)
+		return fmt.Sprintf(`<a class="%s" href="%s">%s</a>`, class, html.EscapeString(pageLink.URL()), label)
+	})
+
+	return content, links
+}
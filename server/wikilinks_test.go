@@ -0,0 +1,25 @@
+package server
+
+import "testing"
+
+func TestRenderWikiLinks(t *testing.T) {
+	index := newPageIndex([]string{"Home.md", "Page-Name.md", "runbooks/db-failover.md", "runbooks/notes.md", "design/notes.md"})
+
+	cases := []struct {
+		content string
+		want    string
+	}{
+		{`[[Page Name]]`, `<a class="wiki-link" href="/Page-Name">Page Name</a>`},
+		{`[[Start|home]]`, `<a class="wiki-link" href="/">Start</a>`},
+		{`[[Failover|DB Failover#steps]]`, `<a class="wiki-link" href="/runbooks/db-failover#steps">Failover</a>`},
+		{`[[notes]]`, `<a class="wiki-link" href="/design/notes">notes</a>`},
+		{`[[No Such Page]]`, `<a class="wiki-link wiki-link-missing" href="/No-Such-Page">No Such Page</a>`},
+		{`<code>[[Page Name]]</code>`, `<code>[[Page Name]]</code>`},
+	}
+
+	for _, c := range cases {
+		if got, _ := renderWikiLinks(c.content, "design/Home.md", index); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.content, got, c.want)
+		}
+	}
+}